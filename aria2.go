@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// aria2Methods are the supported methods of the aria2 JSON-RPC interface.
+var aria2Methods = []string{
+	"aria2.addUri", "aria2.remove", "aria2.forceRemove", "aria2.pause", "aria2.forcePause",
+	"aria2.unpause", "aria2.tellStatus", "aria2.tellActive", "aria2.tellWaiting", "aria2.tellStopped",
+	"aria2.removeDownloadResult", "aria2.getGlobalStat", "aria2.getVersion",
+	"system.multicall", "system.listMethods",
+}
+
+type aria2Request struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type aria2Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *aria2Error     `json:"error,omitempty"`
+}
+
+type aria2Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// aria2 uses code 1 for all errors of the called method.
+func newAria2Error(err error) *aria2Error {
+	return &aria2Error{Code: 1, Message: err.Error()}
+}
+
+// handleAria2 registers a subset of the aria2 JSON-RPC interface on /jsonrpc, mapped onto the
+// job queue. Job ids are used as GIDs. With a secret, calls need the token:<secret> parameter.
+// Only with allowOriginAll, web pages of other origins may call it (like --rpc-allow-origin-all),
+// otherwise request bodies must be sent as application/json.
+func handleAria2(mux *http.ServeMux, queue *JobQueue, secret string, allowOriginAll bool) {
+	rpc := &aria2RPC{queue: queue, secret: secret}
+
+	if allowOriginAll {
+		mux.HandleFunc("OPTIONS /jsonrpc", func(w http.ResponseWriter, r *http.Request) {
+			// Browser extensions send a preflight request
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	mux.HandleFunc("POST /jsonrpc", func(w http.ResponseWriter, r *http.Request) {
+		if allowOriginAll {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if !isJSONRequest(r) {
+			// Other content types can be sent by any web page without a preflight
+			writeJSON(w, http.StatusUnsupportedMediaType, aria2Response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &aria2Error{Code: -32600, Message: "Content type must be application/json."}})
+			return
+		}
+
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, aria2Response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &aria2Error{Code: -32700, Message: "Parse error."}})
+			return
+		}
+
+		// A batch is an array of requests
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+			var requests []aria2Request
+			if err := json.Unmarshal(body, &requests); err != nil {
+				writeJSON(w, http.StatusBadRequest, aria2Response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &aria2Error{Code: -32600, Message: "Invalid Request."}})
+				return
+			}
+			responses := make([]aria2Response, 0, len(requests))
+			for _, request := range requests {
+				responses = append(responses, rpc.handle(request))
+			}
+			writeJSON(w, http.StatusOK, responses)
+			return
+		}
+
+		var request aria2Request
+		if err := json.Unmarshal(body, &request); err != nil {
+			writeJSON(w, http.StatusBadRequest, aria2Response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &aria2Error{Code: -32600, Message: "Invalid Request."}})
+			return
+		}
+		response := rpc.handle(request)
+		status := http.StatusOK
+		if response.Error != nil {
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, response)
+	})
+}
+
+type aria2RPC struct {
+	queue  *JobQueue
+	secret string
+}
+
+// handle runs one JSON-RPC request.
+func (rpc *aria2RPC) handle(request aria2Request) aria2Response {
+	response := aria2Response{JSONRPC: "2.0", ID: request.ID}
+	if response.ID == nil {
+		response.ID = json.RawMessage("null")
+	}
+	result, err := rpc.call(request.Method, request.Params)
+	if err != nil {
+		response.Error = newAria2Error(err)
+		return response
+	}
+	response.Result = result
+	return response
+}
+
+// call runs a method. The token parameter is checked and removed first.
+func (rpc *aria2RPC) call(method string, params []json.RawMessage) (any, error) {
+	if method != "system.multicall" && method != "system.listMethods" {
+		var err error
+		params, err = rpc.authorize(params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch method {
+	case "aria2.addUri":
+		return rpc.addURI(params)
+	case "aria2.remove", "aria2.forceRemove":
+		return rpc.withGID(params, func(gid string) (any, error) {
+			_, err := rpc.queue.Cancel(gid)
+			return gid, err
+		})
+	case "aria2.pause", "aria2.forcePause":
+		return rpc.withGID(params, func(gid string) (any, error) {
+			_, err := rpc.queue.Pause(gid)
+			return gid, err
+		})
+	case "aria2.unpause":
+		return rpc.withGID(params, func(gid string) (any, error) {
+			_, err := rpc.queue.Unpause(gid)
+			return gid, err
+		})
+	case "aria2.removeDownloadResult":
+		return rpc.withGID(params, func(gid string) (any, error) {
+			return "OK", rpc.queue.Remove(gid)
+		})
+	case "aria2.tellStatus":
+		return rpc.withGID(params, func(gid string) (any, error) {
+			view, err := rpc.queue.Get(gid)
+			if err != nil {
+				return nil, err
+			}
+			var keys []string
+			if len(params) > 1 {
+				if err := json.Unmarshal(params[1], &keys); err != nil {
+					return nil, errors.New("keys must be an array of strings")
+				}
+			}
+			return aria2Status(view, rpc.parts(view), keys), nil
+		})
+	case "aria2.tellActive":
+		var keys []string
+		if len(params) > 0 {
+			if err := json.Unmarshal(params[0], &keys); err != nil {
+				return nil, errors.New("keys must be an array of strings")
+			}
+		}
+		return rpc.tell(keys, 0, -1, "active"), nil
+	case "aria2.tellWaiting", "aria2.tellStopped":
+		var offset, num int
+		var keys []string
+		if len(params) < 2 {
+			return nil, errors.New("offset and num are required")
+		}
+		if err := json.Unmarshal(params[0], &offset); err != nil {
+			return nil, errors.New("offset must be an integer")
+		}
+		if err := json.Unmarshal(params[1], &num); err != nil {
+			return nil, errors.New("num must be an integer")
+		}
+		if len(params) > 2 {
+			if err := json.Unmarshal(params[2], &keys); err != nil {
+				return nil, errors.New("keys must be an array of strings")
+			}
+		}
+		if method == "aria2.tellWaiting" {
+			return rpc.tell(keys, offset, num, "waiting", "paused"), nil
+		}
+		return rpc.tell(keys, offset, num, "complete", "error", "removed"), nil
+	case "aria2.getGlobalStat":
+		return rpc.globalStat(), nil
+	case "aria2.getVersion":
+		return map[string]any{"version": version, "enabledFeatures": []string{}}, nil
+	case "system.listMethods":
+		return aria2Methods, nil
+	case "system.multicall":
+		return rpc.multicall(params)
+	}
+	return nil, fmt.Errorf("no such method: %s", method)
+}
+
+// authorize checks the token:<secret> parameter and returns the remaining parameters.
+func (rpc *aria2RPC) authorize(params []json.RawMessage) ([]json.RawMessage, error) {
+	var token string
+	if len(params) > 0 && json.Unmarshal(params[0], &token) == nil && strings.HasPrefix(token, "token:") {
+		params = params[1:]
+	} else {
+		token = ""
+	}
+	if rpc.secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte("token:"+rpc.secret)) != 1 {
+		return nil, errors.New("Unauthorized")
+	}
+	return params, nil
+}
+
+// withGID calls fn with the GID from the first parameter.
+func (rpc *aria2RPC) withGID(params []json.RawMessage, fn func(gid string) (any, error)) (any, error) {
+	var gid string
+	if len(params) == 0 || json.Unmarshal(params[0], &gid) != nil {
+		return nil, errors.New("GID is required")
+	}
+	return fn(gid)
+}
+
+// addURI queues a job. Only the first URI is used, the rest are mirrors aria2 would
+// download from at the same time. Of the options dir, out, split and allow-overwrite are used.
+func (rpc *aria2RPC) addURI(params []json.RawMessage) (any, error) {
+	var uris []string
+	if len(params) == 0 || json.Unmarshal(params[0], &uris) != nil || len(uris) == 0 {
+		return nil, errors.New("URIs are required")
+	}
+	options := map[string]string{}
+	if len(params) > 1 {
+		if err := json.Unmarshal(params[1], &options); err != nil {
+			return nil, errors.New("options must be an object with string values")
+		}
+	}
+
+	job := Job{URL: uris[0], Dir: options["dir"], Output: options["out"], Overwrite: options["allow-overwrite"] == "true"}
+	if split := options["split"]; split != "" {
+		n, err := strconv.Atoi(split)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid split %q", split)
+		}
+		job.MaxWorkers = n
+	}
+
+	view, err := rpc.queue.Add(job)
+	if err != nil {
+		return nil, err
+	}
+	return view.ID, nil
+}
+
+// tell returns the status of jobs in the given aria2 states.
+func (rpc *aria2RPC) tell(keys []string, offset, num int, states ...string) []map[string]any {
+	var matching []map[string]any
+	for _, view := range rpc.queue.List() {
+		if slices.Contains(states, aria2State(view)) {
+			matching = append(matching, aria2Status(view, rpc.parts(view), keys))
+		}
+	}
+	if offset < 0 || offset > len(matching) {
+		offset = len(matching)
+	}
+	matching = matching[offset:]
+	if num >= 0 && num < len(matching) {
+		matching = matching[:num]
+	}
+	if matching == nil {
+		matching = []map[string]any{}
+	}
+	return matching
+}
+
+// globalStat returns the overall speed and number of jobs in each state.
+func (rpc *aria2RPC) globalStat() map[string]string {
+	var speed float64
+	var active, waiting, stopped int
+	for _, view := range rpc.queue.List() {
+		if view.Progress != nil {
+			speed += view.Progress.Speed
+		}
+		switch aria2State(view) {
+		case "active":
+			active++
+		case "waiting", "paused":
+			waiting++
+		default:
+			stopped++
+		}
+	}
+	return map[string]string{
+		"downloadSpeed":   strconv.FormatInt(int64(speed), 10),
+		"uploadSpeed":     "0",
+		"numActive":       strconv.Itoa(active),
+		"numWaiting":      strconv.Itoa(waiting),
+		"numStopped":      strconv.Itoa(stopped),
+		"numStoppedTotal": strconv.Itoa(stopped),
+	}
+}
+
+// multicall runs several calls, each result is wrapped in an array, errors are not.
+func (rpc *aria2RPC) multicall(params []json.RawMessage) (any, error) {
+	var calls []struct {
+		MethodName string            `json:"methodName"`
+		Params     []json.RawMessage `json:"params"`
+	}
+	if len(params) == 0 || json.Unmarshal(params[0], &calls) != nil {
+		return nil, errors.New("an array of calls is required")
+	}
+
+	results := make([]any, 0, len(calls))
+	for _, call := range calls {
+		if call.MethodName == "system.multicall" {
+			results = append(results, newAria2Error(errors.New("recursive system.multicall forbidden")))
+			continue
+		}
+		result, err := rpc.call(call.MethodName, call.Params)
+		if err != nil {
+			results = append(results, newAria2Error(err))
+			continue
+		}
+		results = append(results, []any{result})
+	}
+	return results, nil
+}
+
+// parts returns the parts of a running job.
+func (rpc *aria2RPC) parts(view JobView) []FilePart {
+	if download, err := rpc.queue.Download(view.ID); err == nil {
+		return download.Parts()
+	}
+	return nil
+}
+
+// aria2State maps the job state to the aria2 status.
+func aria2State(view JobView) string {
+	switch view.State {
+	case JobQueued, JobRunning:
+		if view.Paused || (view.Progress != nil && view.Progress.Paused) {
+			return "paused"
+		}
+		if view.State == JobQueued {
+			return "waiting"
+		}
+		return "active"
+	case JobDone:
+		return "complete"
+	case JobFailed:
+		return "error"
+	}
+	return "removed"
+}
+
+// aria2Status returns the job in the format of aria2.tellStatus, limited to keys if any are given.
+// Each part of the file is one piece.
+func aria2Status(view JobView, parts []FilePart, keys []string) map[string]any {
+	var total, completed, pieceLength int64
+	var speed float64
+	var connections, pieces int
+	bitfield := ""
+	if view.Progress != nil {
+		total, completed, speed = max(view.Progress.Size, 0), view.Progress.Downloaded, view.Progress.Speed
+		connections, pieces = view.Progress.ActiveWorkers, view.Progress.PartsTotal
+		bitfield = aria2Bitfield(parts)
+	} else if view.State == JobDone {
+		total, completed, pieces = view.Size, view.Size, 1
+		bitfield = "80"
+	}
+	if pieces > 0 {
+		pieceLength = (total + int64(pieces) - 1) / int64(pieces)
+	}
+
+	path, dir := view.Path, ""
+	if view.Progress != nil {
+		path = view.Progress.Output
+	}
+	if path != "" {
+		dir = filepath.Dir(path)
+	}
+	status := map[string]any{
+		"gid":             view.ID,
+		"status":          aria2State(view),
+		"totalLength":     strconv.FormatInt(total, 10),
+		"completedLength": strconv.FormatInt(completed, 10),
+		"uploadLength":    "0",
+		"downloadSpeed":   strconv.FormatInt(int64(speed), 10),
+		"uploadSpeed":     "0",
+		"connections":     strconv.Itoa(connections),
+		"numPieces":       strconv.Itoa(pieces),
+		"pieceLength":     strconv.FormatInt(pieceLength, 10),
+		"bitfield":        bitfield,
+		"errorCode":       "0",
+		"errorMessage":    view.Error,
+		"dir":             dir,
+		"files": []map[string]any{{
+			"index":           "1",
+			"path":            path,
+			"length":          strconv.FormatInt(total, 10),
+			"completedLength": strconv.FormatInt(completed, 10),
+			"selected":        "true",
+			"uris":            []map[string]string{{"uri": view.URL, "status": "used"}},
+		}},
+	}
+	if view.State == JobFailed {
+		status["errorCode"] = "1"
+	}
+
+	if len(keys) == 0 {
+		return status
+	}
+	filtered := make(map[string]any, len(keys))
+	for _, key := range keys {
+		if value, ok := status[key]; ok {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+// aria2Bitfield returns the downloaded parts as a hex string, the highest bit of the first byte is the first part.
+func aria2Bitfield(parts []FilePart) string {
+	bits := make([]byte, (len(parts)+7)/8)
+	for i, part := range parts {
+		if part.Downloaded {
+			bits[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return hex.EncodeToString(bits)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// LocalAddresses returns the local IPs outgoing connections can be bound to, taken
+// from a comma-separated list of IPs and all addresses of the given network interfaces.
+func LocalAddresses(bind, interfaces string) ([]string, error) {
+	var addrs []string
+	seen := make(map[string]bool)
+	add := func(ip net.IP) {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			addrs = append(addrs, ip.String())
+		}
+	}
+
+	for field := range strings.SplitSeq(bind, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address: %q", field)
+		}
+		add(ip)
+	}
+
+	for name := range strings.SplitSeq(interfaces, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		ips, err := interfaceAddresses(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			add(ip)
+		}
+	}
+
+	return addrs, nil
+}
+
+// interfaceAddresses returns the usable unicast IPs of a network interface.
+// Link-local addresses are skipped, they cannot reach the internet.
+func interfaceAddresses(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("network interface %s: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("network interface %s: %w", name, err)
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("network interface %s has no usable addresses", name)
+	}
+	return ips, nil
+}
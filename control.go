@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiSource is the source name of proxies added through the control API.
+const apiSource = "api"
+
+// ServeControl starts the control API of a running download on addr in the background.
+// The returned listener should be closed on exit, which also removes a unix socket.
+func ServeControl(addr string, download *Download, pool *ProxyPool) (net.Listener, error) {
+	listener, err := listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	handleDownload(mux, "", func(r *http.Request) (*Download, error) {
+		return download, nil
+	})
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		if err := download.Pause(); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, download.Status())
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		download.Resume()
+		writeJSON(w, http.StatusOK, download.Status())
+	})
+	handleProxies(mux, pool)
+	go http.Serve(listener, mux)
+	return listener, nil
+}
+
+// listen listens on a TCP address or, with the unix: prefix, on a unix socket path.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// Remove the socket left by a previous run
+	if info, err := os.Stat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Chmod(path, 0600)
+	return listener, nil
+}
+
+// handleDownload registers the routes showing a download and changing its workers under prefix.
+// lookup returns the download a request refers to.
+func handleDownload(mux *http.ServeMux, prefix string, lookup func(r *http.Request) (*Download, error)) {
+	handle := func(pattern string, handler func(w http.ResponseWriter, r *http.Request, download *Download)) {
+		method, path, _ := strings.Cut(pattern, " ")
+		mux.HandleFunc(method+" "+prefix+path, func(w http.ResponseWriter, r *http.Request) {
+			download, err := lookup(r)
+			if err != nil {
+				writeError(w, http.StatusNotFound, err)
+				return
+			}
+			handler(w, r, download)
+		})
+	}
+
+	handle("GET /status", func(w http.ResponseWriter, r *http.Request, download *Download) {
+		writeJSON(w, http.StatusOK, download.Status())
+	})
+	handle("GET /parts", func(w http.ResponseWriter, r *http.Request, download *Download) {
+		writeJSON(w, http.StatusOK, download.Parts())
+	})
+	handle("POST /max", func(w http.ResponseWriter, r *http.Request, download *Download) {
+		var body struct {
+			Max int `json:"max"`
+		}
+		if err := decodeJSON(w, r, &body); err != nil {
+			return
+		}
+		if err := download.SetMaxWorkers(body.Max); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrNotSupported) {
+				status = http.StatusConflict
+			}
+			writeError(w, status, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, download.Status())
+	})
+	handle("GET /workers", func(w http.ResponseWriter, r *http.Request, download *Download) {
+		writeJSON(w, http.StatusOK, download.Workers())
+	})
+	handle("GET /errors", func(w http.ResponseWriter, r *http.Request, download *Download) {
+		writeJSON(w, http.StatusOK, download.RecentErrors())
+	})
+	handle("POST /skip", func(w http.ResponseWriter, r *http.Request, download *Download) {
+		var body struct {
+			Worker int `json:"worker"`
+		}
+		if err := decodeJSON(w, r, &body); err != nil {
+			return
+		}
+		if err := download.SkipProxy(body.Worker); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, download.Workers())
+	})
+}
+
+// handleProxies registers the routes listing and adding proxies of the pool.
+func handleProxies(mux *http.ServeMux, pool *ProxyPool) {
+	mux.HandleFunc("GET /proxies", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pool.Snapshot())
+	})
+	mux.HandleFunc("POST /proxies", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Proxies []string `json:"proxies"`
+		}
+		if err := decodeJSON(w, r, &body); err != nil {
+			return
+		}
+		// Lines are parsed like a proxy list file, so attributes and templates work too
+		entries, err := ParseProxyList(strings.NewReader(strings.Join(body.Proxies, "\n")), apiSource)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		added := pool.Add(entries)
+		writeJSON(w, http.StatusOK, map[string]int{"added": added})
+	})
+}
+
+// writeJSON writes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as a JSON error response.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// decodeJSON decodes the JSON request body into v, or writes an error response.
+// The body must be sent as application/json, which web pages cannot do without
+// a CORS preflight, so they cannot use the API from the user's browser.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	if !isJSONRequest(r) {
+		err := errors.New("content type must be application/json")
+		writeError(w, http.StatusUnsupportedMediaType, err)
+		return err
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return err
+	}
+	return nil
+}
+
+// isJSONRequest reports whether the request body is sent as application/json.
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// requireSecret passes only requests with the "Authorization: Bearer <secret>" header
+// or, for browsers opening the dashboard, the secret=<secret> query parameter to next.
+// Without a secret, all requests are passed.
+func requireSecret(secret string, next http.Handler) http.Handler {
+	if secret == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = r.URL.Query().Get("secret")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
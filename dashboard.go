@@ -0,0 +1,105 @@
+package main
+
+import (
+	"cmp"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//go:embed web/dashboard.html
+var dashboardHTML []byte
+
+// dashboardInterval is how often the dashboard is updated.
+const dashboardInterval = time.Second
+
+// DashboardJob is a job with the part map of its download while it is running.
+type DashboardJob struct {
+	JobView
+	Parts []FilePart `json:"parts,omitempty"`
+}
+
+// DashboardProxy is the state of a proxy with its statistics since the daemon started.
+type DashboardProxy struct {
+	ProxyStatus
+	Bytes      int64          `json:"bytes"`
+	Parts      int            `json:"parts"`
+	Errors     map[string]int `json:"errors,omitempty"` // FailureReason -> count
+	Throughput float64        `json:"throughput"`       // bytes per second while downloading
+}
+
+// DashboardSnapshot is sent to the dashboard on every update.
+type DashboardSnapshot struct {
+	Jobs    []DashboardJob   `json:"jobs"`
+	Proxies []DashboardProxy `json:"proxies"`
+}
+
+// handleDashboard registers the web dashboard on / and its live updates on /dashboard/events.
+// Jobs are added and canceled by the dashboard through the job API.
+func handleDashboard(mux *http.ServeMux, queue *JobQueue, pool *ProxyPool) {
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+
+	// Server-sent events with a full snapshot each time, the dashboard replaces its view with it
+	mux.HandleFunc("GET /dashboard/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		ticker := time.NewTicker(dashboardInterval)
+		defer ticker.Stop()
+		for {
+			data, err := json.Marshal(dashboardSnapshot(queue, pool))
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// dashboardSnapshot collects the jobs, part maps and proxy statistics.
+func dashboardSnapshot(queue *JobQueue, pool *ProxyPool) DashboardSnapshot {
+	snapshot := DashboardSnapshot{Jobs: []DashboardJob{}, Proxies: []DashboardProxy{}}
+	for _, view := range queue.List() {
+		job := DashboardJob{JobView: view}
+		if download, err := queue.Download(view.ID); err == nil {
+			job.Parts = download.Parts()
+		}
+		snapshot.Jobs = append(snapshot.Jobs, job)
+	}
+
+	reports := make(map[string]ProxyReport)
+	for _, report := range runStats.Report().Proxies {
+		reports[report.Proxy] = report
+	}
+	for _, status := range pool.Snapshot() {
+		// Gateway sessions share the statistics of their template
+		report := reports[cmp.Or(status.Template, status.Proxy)]
+		snapshot.Proxies = append(snapshot.Proxies, DashboardProxy{
+			ProxyStatus: status,
+			Bytes:       report.Bytes,
+			Parts:       report.Parts,
+			Errors:      report.Failures,
+			Throughput:  report.Throughput,
+		})
+	}
+	return snapshot
+}
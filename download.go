@@ -0,0 +1,935 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/log"
+	"github.com/schollz/progressbar/v3"
+)
+
+// ErrOutputExists is returned when the output file exists and overwriting is not allowed.
+var ErrOutputExists = errors.New("file already exists")
+
+// ErrNotSupported is returned when pausing or scaling a single stream download.
+var ErrNotSupported = errors.New("not supported for single stream downloads")
+
+// Download states reported by Status.
+const (
+	StateProbing       = "probing"
+	StateDownloading   = "downloading"
+	StateConcatenating = "concatenating"
+	StateDone          = "done"
+	StateFailed        = "failed"
+	StateCanceled      = "canceled"
+)
+
+// DownloadOptions configures a single file download.
+type DownloadOptions struct {
+	URL        string
+	Output     string // output path, the file name sent by the server if empty
+	Overwrite  bool
+	PartSize   int64
+	MaxWorkers int
+
+	Dir          string // directory for relative output paths, the working directory if empty
+	WorkerPrefix string // prefix of the worker ids, for several downloads sharing the proxy pool
+	Quiet        bool   // no progress bar or progress logs
+	Shared       bool   // one of several downloads at once, no metrics and run statistics
+}
+
+// Download downloads one file in parts through the proxy pool. The number of
+// workers can be changed and the download paused while it is running.
+type Download struct {
+	opts DownloadOptions
+	pool *ProxyPool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu             sync.Mutex
+	cond           *sync.Cond // signalled when workers exit, on pause/resume and cancel
+	state          string
+	err            error
+	info           FileInfo
+	source         *Source
+	outputPath     string
+	workDir        string
+	singleStream   bool
+	parts          []FilePart
+	partsChan      chan FilePart
+	downloaded     int64
+	history        []dataPoint
+	maxWorkers     int
+	workers        int // running worker goroutines
+	nextWorkerID   int
+	paused         bool
+	bar            *progressbar.ProgressBar
+	progressUpdate chan struct{}
+	activeWorkers  atomic.Int64
+	workerStates   map[int]*workerState
+	recentErrors   []DownloadError
+}
+
+// maxRecentErrors is the number of failed attempts kept for RecentErrors.
+const maxRecentErrors = 20
+
+// ErrSkipped is the error of an attempt canceled by SkipProxy.
+var ErrSkipped = errors.New("proxy skipped")
+
+type workerState struct {
+	proxy      string
+	part       int // -1 if idle
+	size       int64
+	downloaded int64
+	started    time.Time
+	cancel     context.CancelFunc // cancels the current attempt
+	skipped    bool
+}
+
+// WorkerStatus is what a worker is doing.
+type WorkerStatus struct {
+	Worker     int     `json:"worker"`
+	Proxy      string  `json:"proxy,omitempty"`
+	Part       int     `json:"part"` // -1 if idle
+	Size       int64   `json:"size"`
+	Downloaded int64   `json:"downloaded"` // bytes of the current part
+	Speed      float64 `json:"speed"`      // bytes per second of the current part
+}
+
+// DownloadError is a failed attempt to download a part.
+type DownloadError struct {
+	Time   time.Time `json:"time"`
+	Worker int       `json:"worker"`
+	Proxy  string    `json:"proxy"`
+	Part   int       `json:"part"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error"`
+}
+
+type dataPoint struct {
+	timestamp time.Time
+	bytes     int64
+}
+
+// DownloadStatus is a snapshot of the download progress.
+type DownloadStatus struct {
+	URL           string  `json:"url"`
+	Output        string  `json:"output"`
+	State         string  `json:"state"`
+	Size          int64   `json:"size"` // -1 if unknown
+	Downloaded    int64   `json:"downloaded"`
+	Speed         float64 `json:"speed"` // bytes per second
+	PartsDone     int     `json:"parts_done"`
+	PartsTotal    int     `json:"parts_total"`
+	Paused        bool    `json:"paused"`
+	MaxWorkers    int     `json:"max_workers"`
+	ActiveWorkers int     `json:"active_workers"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// NewDownload prepares a download, it is started by Run.
+func NewDownload(pool *ProxyPool, opts DownloadOptions) *Download {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Download{
+		opts:           opts,
+		pool:           pool,
+		ctx:            ctx,
+		cancel:         cancel,
+		state:          StateProbing,
+		maxWorkers:     max(opts.MaxWorkers, 1),
+		progressUpdate: make(chan struct{}, 1),
+		workerStates:   make(map[int]*workerState),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// OutputPath returns the absolute path of the output file, known once the file info is fetched.
+func (d *Download) OutputPath() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.outputPath
+}
+
+// Run fetches the file info, downloads all parts and concatenates them into the output file.
+func (d *Download) Run() error {
+	err := d.run()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// An error that stopped the workers takes precedence over the cancelation it caused
+	if d.err != nil {
+		err = d.err
+	}
+	switch {
+	case err == nil:
+		d.state = StateDone
+	case errors.Is(err, context.Canceled):
+		d.state = StateCanceled
+	default:
+		d.state = StateFailed
+	}
+	d.err = err
+	return err
+}
+
+func (d *Download) run() error {
+	defer d.cancel()
+
+	// Get file lenght
+	// TODO: use proxy for this
+	var fileInfo FileInfo
+	var err error
+	var retryCounter = 0
+	for {
+		if retryCounter >= 3 {
+			return fmt.Errorf("failed to get file info: %w", err)
+		}
+
+		fileInfo, err = GetFileInfo(d.opts.URL, "")
+		if err != nil {
+			retryCounter++
+			log.Error("Error getting file content length.", "err", err)
+			continue
+		}
+		break
+	}
+	contentLength := fileInfo.ContentLength
+
+	// Determine output absolute path
+	outputPath := d.opts.Output
+	if outputPath == "" {
+		outputPath = fileInfo.Name
+	}
+	if d.opts.Dir != "" && !filepath.IsAbs(outputPath) {
+		outputPath = filepath.Join(d.opts.Dir, outputPath)
+	}
+	absOutputPath, workDir, err := PrepareOutputPath(outputPath)
+	if err != nil {
+		return err
+	}
+	log.Debug("", "Working directory", workDir)
+	log.Debug("", "Output file", absOutputPath)
+
+	d.mu.Lock()
+	d.info = fileInfo
+	// Workers download from the final URL directly instead of following redirects for every part
+	d.source = NewSource(d.opts.URL, fileInfo, NewRefreshFunc(refreshCmd, refreshURL))
+	d.outputPath = absOutputPath
+	d.workDir = workDir
+	d.singleStream = !fileInfo.AcceptRanges || contentLength <= 0
+	d.mu.Unlock()
+
+	// Check if the output file already exists
+	if _, err := os.Stat(absOutputPath); err == nil && !d.opts.Overwrite {
+		return ErrOutputExists
+	}
+
+	// Servers without range support can only be downloaded in one piece
+	if d.singleStream {
+		log.Info("Fetched file info.", "name", fileInfo.Name, "length", contentLength)
+		log.Warn("Server does not support partial downloads. Falling back to single stream download.")
+		d.setState(StateDownloading)
+		d.emitStarted(DownloadStartedEvent{URL: d.opts.URL, Output: absOutputPath, Size: contentLength, Parts: 1, PartSize: contentLength, Workers: 1, SingleStream: true})
+		if !d.opts.Shared {
+			runStats.Start()
+			defer runStats.Finish()
+		}
+		return d.downloadSingleStream()
+	}
+
+	// Calculate parts
+	fileParts := DivideFileIntoParts(contentLength, d.opts.PartSize)
+	log.Info("Fetched file info.", "name", fileInfo.Name, "length", contentLength, "size", fmt.Sprintf("%d MB", contentLength/(1024*1024)), "parts", len(fileParts))
+
+	// Check if contentLength changed when redownloading. If not redownloading then save it to file.
+	infoFilePath, err := SaveContentLengthToFile(workDir, filepath.Base(absOutputPath), contentLength, fileInfo.ETag)
+	if err != nil {
+		return err
+	}
+
+	// Check if the number of parts is less than the maximum concurrent downloads
+	d.mu.Lock()
+	d.parts = fileParts
+	if len(fileParts) < d.maxWorkers {
+		d.maxWorkers = len(fileParts)
+		log.Warn("Adjusting maximum concurrent connections to number of parts.")
+	}
+	d.mu.Unlock()
+
+	// Create a channel to pass the parts to download
+	partsChan := make(chan FilePart, len(fileParts))
+	for _, part := range fileParts {
+		partsChan <- part
+	}
+	close(partsChan)
+
+	done := make(chan struct{})
+	defer close(done)
+	d.startReporting(done)
+
+	// Progress bar
+	var bar *progressbar.ProgressBar
+	switch {
+	case d.opts.Quiet:
+	case verbose:
+		d.mu.Lock()
+		PrintDownloadStatus(fileParts, d.opts.PartSize, contentLength, d.downloaded, 0)
+		d.mu.Unlock()
+	default:
+		bar = progressbar.NewOptions(int(contentLength),
+			progressbar.OptionSetWriter(consoleOut),
+			progressbar.OptionSetMaxDetailRow(1),
+			progressbar.OptionShowCount(),
+			progressbar.OptionEnableColorCodes(true),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionFullWidth(),
+			progressbar.OptionSetDescription("Downloading:"),
+			progressbar.OptionSetTheme(progressbar.Theme{
+				Saucer:        lipgloss.NewStyle().Foreground(lipgloss.Color("86")).Render("━"),
+				SaucerHead:    lipgloss.NewStyle().Foreground(lipgloss.Color("86")).Render("━"),
+				SaucerPadding: " ",
+				BarStart:      "┃",
+				BarEnd:        "┃",
+			}))
+	}
+
+	d.emitStarted(DownloadStartedEvent{URL: d.opts.URL, Output: absOutputPath, Size: contentLength, Parts: len(fileParts), PartSize: d.opts.PartSize, Workers: d.maxWorkers})
+	if !d.opts.Shared {
+		runStats.Start()
+	}
+
+	// Create a pool of workers (goroutines) for downloading and wait for all of them
+	d.mu.Lock()
+	d.partsChan = partsChan
+	d.bar = bar
+	d.state = StateDownloading
+	d.startWorkersLocked()
+	for d.workers > 0 {
+		d.cond.Wait()
+	}
+	missing := len(d.parts) - d.partsDoneLocked()
+	d.mu.Unlock()
+
+	if bar != nil {
+		bar.Finish()
+		fmt.Fprintln(consoleOut, "")
+	}
+	if !d.opts.Shared {
+		runStats.Finish()
+	}
+	if err := d.ctx.Err(); err != nil {
+		return err
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d file parts were not downloaded", missing)
+	}
+
+	log.Info("All file parts downloaded. Concatenating file...")
+	d.setState(StateConcatenating)
+
+	// Concatenate parts into output file
+	err = ConcatenateFiles(absOutputPath, workDir)
+	if err != nil {
+		return fmt.Errorf("error concatenating files: %w", err)
+	}
+
+	// Verify the final file size
+	finalFileInfo, err := os.Stat(absOutputPath)
+	if err != nil {
+		log.Error("Couldn't read file", "err", err)
+	} else {
+		if finalFileInfo.Size() != contentLength {
+			log.Error("File size verification failed.", "size", finalFileInfo.Size(), "expected size", contentLength)
+		}
+	}
+
+	// Delete the info file
+	err = os.Remove(infoFilePath)
+	if err != nil {
+		log.Error("Error deleting info file.", "err", err)
+	}
+	return nil
+}
+
+func (d *Download) setState(state string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state = state
+}
+
+// startReporting starts the periodic progress output, events and metrics until done is closed.
+func (d *Download) startReporting(done <-chan struct{}) {
+	// Periodic JSON reporting, single stream downloads log their own progress
+	if jsonOutput && !d.singleStream && !d.opts.Quiet {
+		go func() {
+			ticker := time.NewTicker(5 * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				case <-d.progressUpdate:
+					ticker.Reset(5 * time.Second)
+				}
+				d.mu.Lock()
+				reportProgress(d.parts, d.downloaded, d.currentSpeedLocked(), d.info.ContentLength)
+				d.mu.Unlock()
+			}
+		}()
+	}
+
+	// Periodic progress events with raw numbers
+	if events != nil {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					status := d.Status()
+					events.Emit(EventProgress, ProgressEvent{Downloaded: status.Downloaded, Total: status.Size, Speed: status.Speed, PartsCompleted: status.PartsDone, PartsTotal: status.PartsTotal})
+				}
+			}
+		}()
+	}
+
+	// Metrics fed from the same counters as the progress
+	if d.opts.Shared {
+		return
+	}
+	metrics.RegisterGauge("mpd_file_size_bytes", "Size of the file being downloaded.", func() float64 {
+		return float64(d.Status().Size)
+	})
+	metrics.RegisterGauge("mpd_downloaded_bytes", "Bytes of the file downloaded so far.", func() float64 {
+		return float64(d.Status().Downloaded)
+	})
+	metrics.RegisterGauge("mpd_download_speed_bytes", "Current download speed in bytes per second.", func() float64 {
+		return d.Status().Speed
+	})
+	metrics.RegisterGauge("mpd_parts_done", "Parts downloaded and verified.", func() float64 {
+		return float64(d.Status().PartsDone)
+	})
+	metrics.RegisterGauge("mpd_parts_total", "Number of parts of the file.", func() float64 {
+		return float64(d.Status().PartsTotal)
+	})
+	metrics.RegisterGauge("mpd_active_workers", "Workers currently downloading a part.", func() float64 {
+		return float64(d.activeWorkers.Load())
+	})
+}
+
+// currentSpeedLocked returns the download speed over the last 10 seconds. Caller must hold lock.
+func (d *Download) currentSpeedLocked() float64 {
+	now := time.Now()
+	d.history = append(d.history, dataPoint{timestamp: now, bytes: d.downloaded})
+	for len(d.history) > 0 && now.Sub(d.history[0].timestamp) > 10*time.Second {
+		d.history = d.history[1:]
+	}
+	if len(d.history) > 1 {
+		duration := d.history[len(d.history)-1].timestamp.Sub(d.history[0].timestamp).Seconds()
+		if duration > 0 {
+			return float64(d.history[len(d.history)-1].bytes-d.history[0].bytes) / duration
+		}
+	}
+	return 0.0
+}
+
+// partsDoneLocked returns the number of downloaded parts. Caller must hold lock.
+func (d *Download) partsDoneLocked() int {
+	done := 0
+	for _, part := range d.parts {
+		if part.Downloaded {
+			done++
+		}
+	}
+	return done
+}
+
+// Status returns the current progress of the download.
+func (d *Download) Status() DownloadStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := DownloadStatus{
+		URL:           d.opts.URL,
+		Output:        d.outputPath,
+		State:         d.state,
+		Size:          d.info.ContentLength,
+		Downloaded:    d.downloaded,
+		Speed:         d.currentSpeedLocked(),
+		PartsDone:     d.partsDoneLocked(),
+		PartsTotal:    len(d.parts),
+		Paused:        d.paused,
+		MaxWorkers:    d.maxWorkers,
+		ActiveWorkers: int(d.activeWorkers.Load()),
+		Error:         errorString(d.err),
+	}
+	if d.singleStream {
+		status.PartsTotal = 1
+		status.MaxWorkers = 1
+		if d.state == StateDone {
+			status.PartsDone = 1
+		}
+	}
+	return status
+}
+
+// Parts returns a copy of the part list.
+func (d *Download) Parts() []FilePart {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	parts := make([]FilePart, len(d.parts))
+	copy(parts, d.parts)
+	return parts
+}
+
+// Pause stops workers from starting new parts. Parts in progress are finished.
+func (d *Download) Pause() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.singleStream {
+		return ErrNotSupported
+	}
+	d.paused = true
+	return nil
+}
+
+// Resume continues a paused download.
+func (d *Download) Resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.paused = false
+	d.cond.Broadcast()
+}
+
+// SetMaxWorkers changes the number of concurrent workers. New workers start immediately,
+// workers above the new limit stop after their current part.
+func (d *Download) SetMaxWorkers(n int) error {
+	if n < 1 {
+		return errors.New("the number of workers must be at least 1")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.singleStream {
+		return ErrNotSupported
+	}
+	d.maxWorkers = n
+	if d.state == StateDownloading {
+		d.startWorkersLocked()
+	}
+	d.cond.Broadcast()
+	return nil
+}
+
+// Cancel stops the download. Run returns context.Canceled.
+func (d *Download) Cancel() {
+	d.cancel()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cond.Broadcast()
+}
+
+// startWorkersLocked starts workers up to the limit. Caller must hold lock.
+func (d *Download) startWorkersLocked() {
+	for d.workers < d.maxWorkers && d.workers < len(d.partsChan) {
+		d.workers++
+		go d.worker(d.nextWorkerID)
+		d.nextWorkerID++
+	}
+}
+
+// worker downloads parts until there are none left, the download is canceled
+// or the number of workers is reduced.
+func (d *Download) worker(workerID int) {
+	stopped := false
+	defer func() {
+		d.mu.Lock()
+		if !stopped {
+			d.workers--
+		}
+		delete(d.workerStates, workerID)
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	}()
+
+	for {
+		d.mu.Lock()
+		for d.paused && d.ctx.Err() == nil {
+			d.cond.Wait()
+		}
+		// Leave the pool right away, so that other workers checking the limit
+		// at the same time do not stop as well
+		stop := d.workers > d.maxWorkers || d.ctx.Err() != nil
+		if stop {
+			d.workers--
+			stopped = true
+		}
+		d.mu.Unlock()
+		if stop {
+			// The pool keeps the proxy assigned until it is released
+			_ = d.pool.Release(d.workerKey(workerID))
+			return
+		}
+
+		part, ok := <-d.partsChan
+		if !ok {
+			return
+		}
+		if err := d.downloadPart(workerID, part); err != nil {
+			return
+		}
+	}
+}
+
+// downloadPart downloads one part, switching proxies until it succeeds.
+// Returns an error only if the download is canceled or no proxy is available.
+func (d *Download) downloadPart(workerID int, part FilePart) error {
+	pool, bar := d.pool, d.bar
+	contentLength := d.info.ContentLength
+	partFileName := fmt.Sprintf("%s.%d.part", filepath.Base(d.outputPath), part.Number)
+	partAbsPath := filepath.Join(d.workDir, partFileName)
+	partSize := part.End - part.Start + 1
+
+	// Check if the part file already exists and has the correct size
+	fileInfo, err := os.Stat(partAbsPath)
+	if err == nil {
+		if fileInfo.Size() == partSize {
+			if bar != nil {
+				bar.Add(int(partSize))
+			}
+			d.mu.Lock()
+			d.parts[part.Number].Downloaded = true
+			d.downloaded += partSize
+			d.printProgressLocked(contentLength)
+			d.mu.Unlock()
+			return nil
+		} else {
+			err := os.Remove(partAbsPath)
+			if err != nil {
+				log.Error("Error deleting part.", "path", partAbsPath, "err", err)
+			}
+		}
+	}
+
+	var retryCounter = 0
+	var proxy *ProxyEntry
+	var lastErr error
+	attempt := 0
+	for {
+		if d.ctx.Err() != nil {
+			_ = pool.Release(d.workerKey(workerID))
+			return d.ctx.Err()
+		}
+
+		if (retryCounter >= proxyMaxRetry && proxyMaxRetry != 0) || (retryCounter > proxyMaxRetry && proxyMaxRetry == 0) {
+			retryCounter = 0
+			if proxy != nil {
+				events.Emit(EventProxyFailed, ProxyFailedEvent{Worker: d.workerKey(workerID), Proxy: redactProxy(proxy.String()), Reason: FailureReason(lastErr)})
+			}
+			proxy, err = pool.Fail(d.ctx, d.workerKey(workerID))
+		} else {
+			proxy, err = pool.Assign(d.ctx, d.workerKey(workerID))
+		}
+		if err != nil {
+			// Canceled while waiting for a proxy
+			if d.ctx.Err() != nil {
+				return d.ctx.Err()
+			}
+			log.Error("Error getting proxy URL.", "err", err)
+			d.fail(err)
+			return err
+		}
+
+		client, err := pool.Client(proxy)
+		if err != nil {
+			if verbose && debugProxy {
+				log.Debug(fmt.Sprintf("Worker %d: Invalid proxy address.", workerID), "adress", proxy, "err", err)
+			}
+			lastErr = err
+			retryCounter = proxyMaxRetry + 1
+			continue
+		}
+
+		var localDownloaded int64
+		partURL := d.source.FinalURL()
+		partStart := time.Now()
+		var firstByte time.Duration
+		attempt++
+		d.activeWorkers.Add(1)
+		events.Emit(EventPartStarted, PartStartedEvent{Part: part.Number, Worker: d.workerKey(workerID), Proxy: redactProxy(proxy.String()), Start: part.Start, End: part.End, Attempt: attempt})
+		attemptCtx, state := d.startAttempt(workerID, proxy, part.Number, partSize)
+		downloadedBytes, err := DownloadPartialFile(attemptCtx, client, partURL, proxy.String(), partAbsPath, part.Start, part.End, bar, time.Duration(proxyTimeout)*time.Second, func(n int64) {
+			d.mu.Lock()
+			d.downloaded += n
+			localDownloaded += n
+			state.downloaded += n
+			if firstByte == 0 {
+				firstByte = time.Since(partStart)
+			}
+			d.mu.Unlock()
+			metrics.AddReceived(n)
+		})
+		skipped := d.endAttempt(state)
+		d.activeWorkers.Add(-1)
+		if err != nil {
+			_ = os.Remove(partAbsPath)
+
+			if bar != nil {
+				bar.Add(-int(downloadedBytes))
+			}
+
+			// Reset global counter for the failed part
+			d.mu.Lock()
+			d.downloaded -= localDownloaded
+			d.mu.Unlock()
+
+			// A canceled download is not a failure of the proxy
+			if d.ctx.Err() != nil {
+				continue
+			}
+
+			// A skipped proxy is switched without counting a failure
+			if skipped {
+				d.recordError(workerID, proxy, part.Number, ErrSkipped)
+				events.Emit(EventPartFailed, PartFailedEvent{Part: part.Number, Worker: d.workerKey(workerID), Proxy: redactProxy(proxy.String()),
+					Reason: FailureReason(ErrSkipped), Error: ErrSkipped.Error(), Bytes: downloadedBytes, Duration: time.Since(partStart).Seconds()})
+				lastErr = ErrSkipped
+				retryCounter = 0
+				if _, err := pool.Skip(d.ctx, d.workerKey(workerID)); err != nil {
+					if d.ctx.Err() != nil {
+						return d.ctx.Err()
+					}
+					log.Error("Error getting proxy URL.", "err", err)
+					d.fail(err)
+					return err
+				}
+				continue
+			}
+
+			if verbose && debugProxy {
+				log.Debug(fmt.Sprintf("Worker %d: Error downloading part %d.", workerID, part.Number), "err", err)
+			}
+			d.recordError(workerID, proxy, part.Number, err)
+			recordAttempt(d.statsKey(workerID), proxy, downloadedBytes, time.Since(partStart), firstByte, err)
+			events.Emit(EventPartFailed, PartFailedEvent{Part: part.Number, Worker: d.workerKey(workerID), Proxy: redactProxy(proxy.String()),
+				Reason: FailureReason(err), Error: err.Error(), Bytes: downloadedBytes, Duration: time.Since(partStart).Seconds()})
+			lastErr = err
+
+			// Signed links may expire, follow the redirects of the original URL again
+			if IsLinkExpired(err) {
+				if _, err := d.source.Resolve(partURL); err != nil {
+					log.Error("Failed to resolve download link.", "err", err)
+				}
+			}
+
+			// Slow proxies are switched immediately
+			if errors.Is(err, ErrTooSlow) {
+				retryCounter = proxyMaxRetry + 1
+				continue
+			}
+
+			// Retry indefinitely
+			retryCounter++
+			continue
+		}
+
+		// Verify the size of the downloaded part
+		fileInfo, err = os.Stat(partAbsPath)
+		if err != nil {
+			if verbose {
+				log.Error("Failed to get file part info", "worker id", workerID, "part path", partAbsPath, "err", err)
+			}
+
+			if bar != nil {
+				bar.Add(-int(downloadedBytes))
+			}
+
+			d.mu.Lock()
+			d.downloaded -= localDownloaded
+			d.mu.Unlock()
+
+			retryCounter++
+			continue
+		}
+
+		if fileInfo.Size() != partSize {
+			if verbose {
+				log.Warn(" Part has incorrect size. Redownloading.", "worker id", workerID, "part path", partAbsPath, "current size", fileInfo.Size(), "correct size", part.End-part.Start+1)
+			}
+			d.recordError(workerID, proxy, part.Number, ErrSizeMismatch)
+			recordAttempt(d.statsKey(workerID), proxy, downloadedBytes, time.Since(partStart), firstByte, ErrSizeMismatch)
+			events.Emit(EventPartFailed, PartFailedEvent{Part: part.Number, Worker: d.workerKey(workerID), Proxy: redactProxy(proxy.String()),
+				Reason: FailureReason(ErrSizeMismatch), Error: ErrSizeMismatch.Error(), Bytes: downloadedBytes, Duration: time.Since(partStart).Seconds()})
+			lastErr = ErrSizeMismatch
+
+			err := os.Remove(partAbsPath)
+			if err != nil {
+				log.Error("Failed to delete part.", "part path", partAbsPath, "err", err)
+			}
+			if bar != nil {
+				bar.Add(-int(downloadedBytes))
+			}
+
+			d.mu.Lock()
+			d.downloaded -= localDownloaded
+			d.mu.Unlock()
+
+			retryCounter++
+			continue
+		}
+
+		// Release proxy ip from the worker after succesful download
+		_ = pool.Release(d.workerKey(workerID))
+		recordAttempt(d.statsKey(workerID), proxy, partSize, time.Since(partStart), firstByte, nil)
+		events.Emit(EventPartCompleted, PartCompletedEvent{Part: part.Number, Worker: d.workerKey(workerID), Proxy: redactProxy(proxy.String()),
+			Bytes: partSize, Duration: time.Since(partStart).Seconds()})
+
+		d.mu.Lock()
+		d.parts[part.Number].Downloaded = true
+		d.printProgressLocked(contentLength)
+		d.mu.Unlock()
+		return nil
+	}
+}
+
+// printProgressLocked updates the progress output after a part is done. Caller must hold lock.
+func (d *Download) printProgressLocked(contentLength int64) {
+	if d.opts.Quiet {
+		return
+	}
+	if verbose {
+		if jsonOutput {
+			select {
+			case d.progressUpdate <- struct{}{}:
+			default:
+			}
+		} else {
+			PrintDownloadStatus(d.parts, d.opts.PartSize, contentLength, d.downloaded, d.currentSpeedLocked())
+		}
+	} else {
+		d.bar.AddDetail(DetailsPrompt(d.parts, d.pool.ErrorCount()))
+	}
+}
+
+// startAttempt marks the worker as downloading a part through proxy and returns the
+// context of the attempt, canceled by SkipProxy.
+func (d *Download) startAttempt(workerID int, proxy *ProxyEntry, part int, size int64) (context.Context, *workerState) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	state := &workerState{proxy: redactProxy(proxy.String()), part: part, size: size, started: time.Now(), cancel: cancel}
+	d.mu.Lock()
+	d.workerStates[workerID] = state
+	d.mu.Unlock()
+	return ctx, state
+}
+
+// endAttempt marks the worker as idle and returns whether the attempt was skipped.
+func (d *Download) endAttempt(state *workerState) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state.cancel()
+	state.cancel = nil
+	state.part = -1
+	return state.skipped
+}
+
+// recordError adds a failed attempt to the recent errors.
+func (d *Download) recordError(workerID int, proxy *ProxyEntry, part int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.recentErrors = append(d.recentErrors, DownloadError{
+		Time:   time.Now(),
+		Worker: workerID,
+		Proxy:  redactProxy(proxy.String()),
+		Part:   part,
+		Reason: FailureReason(err),
+		Error:  err.Error(),
+	})
+	if len(d.recentErrors) > maxRecentErrors {
+		d.recentErrors = d.recentErrors[len(d.recentErrors)-maxRecentErrors:]
+	}
+}
+
+// RecentErrors returns the last failed attempts, the oldest first.
+func (d *Download) RecentErrors() []DownloadError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.recentErrors)
+}
+
+// Workers returns the state of the running workers, ordered by id.
+func (d *Download) Workers() []WorkerStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	workers := make([]WorkerStatus, 0, len(d.workerStates))
+	for _, workerID := range slices.Sorted(maps.Keys(d.workerStates)) {
+		state := d.workerStates[workerID]
+		status := WorkerStatus{Worker: workerID, Proxy: state.proxy, Part: state.part}
+		if state.part >= 0 {
+			status.Size = state.size
+			status.Downloaded = state.downloaded
+			if elapsed := time.Since(state.started).Seconds(); elapsed > 0 {
+				status.Speed = float64(state.downloaded) / elapsed
+			}
+		}
+		workers = append(workers, status)
+	}
+	return workers
+}
+
+// SkipProxy stops the current attempt of a worker, which continues the part with the next proxy.
+func (d *Download) SkipProxy(workerID int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.workerStates[workerID]
+	if !ok || state.cancel == nil {
+		return fmt.Errorf("worker %d is not downloading", workerID)
+	}
+	state.skipped = true
+	state.cancel()
+	return nil
+}
+
+// emitStarted sends the started event to the event stream and the webhook.
+func (d *Download) emitStarted(data DownloadStartedEvent) {
+	events.Emit(EventDownloadStarted, data)
+	hooks.Started(data)
+}
+
+// workerKey returns the id of a worker in the proxy pool.
+func (d *Download) workerKey(workerID int) string {
+	return d.opts.WorkerPrefix + strconv.Itoa(workerID)
+}
+
+// statsKey returns the name of a worker in the run statistics. Shared downloads only
+// add to the proxy statistics, the workers of all finished jobs would pile up otherwise.
+func (d *Download) statsKey(workerID int) string {
+	if d.opts.Shared {
+		return ""
+	}
+	return d.workerKey(workerID)
+}
+
+// fail stops the download with err.
+func (d *Download) fail(err error) {
+	d.mu.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.mu.Unlock()
+	d.Cancel()
+}
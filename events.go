@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// eventsVersion is the version of the event schema. It is increased on
+// incompatible changes; new event types and fields can be added without it.
+const eventsVersion = 1
+
+// Event types written to the event stream.
+const (
+	EventDownloadStarted = "download_started"
+	EventPartStarted     = "part_started"
+	EventPartCompleted   = "part_completed"
+	EventPartFailed      = "part_failed"
+	EventProxyFailed     = "proxy_failed"
+	EventProgress        = "progress"
+	EventFinished        = "finished"
+)
+
+// events writes the NDJSON event stream, nil if disabled.
+var events *EventWriter
+
+// consoleOut receives the progress bar. It is stderr when the events are written to stdout.
+var consoleOut io.Writer = os.Stdout
+
+// EventWriter writes one JSON event per line.
+// All methods can be called on a nil writer and do nothing.
+type EventWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// event is the envelope of every event, Data holds the event type specific fields.
+type event struct {
+	Version int       `json:"version"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Data    any       `json:"data"`
+}
+
+// DownloadStartedEvent is sent once the file info is known and the download begins.
+type DownloadStartedEvent struct {
+	URL          string `json:"url"`
+	Output       string `json:"output"`
+	Size         int64  `json:"size"` // -1 if unknown
+	Parts        int    `json:"parts"`
+	PartSize     int64  `json:"part_size"`
+	Workers      int    `json:"workers"`
+	SingleStream bool   `json:"single_stream"`
+}
+
+// PartStartedEvent is sent before each download attempt of a part.
+type PartStartedEvent struct {
+	Part    int    `json:"part"`
+	Worker  string `json:"worker"`
+	Proxy   string `json:"proxy"`
+	Start   int64  `json:"start"`
+	End     int64  `json:"end"` // -1 if the size is unknown
+	Attempt int    `json:"attempt"`
+}
+
+// PartCompletedEvent is sent when a part is downloaded and verified.
+type PartCompletedEvent struct {
+	Part     int     `json:"part"`
+	Worker   string  `json:"worker"`
+	Proxy    string  `json:"proxy"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration"` // seconds
+}
+
+// PartFailedEvent is sent when a download attempt of a part fails.
+type PartFailedEvent struct {
+	Part     int     `json:"part"`
+	Worker   string  `json:"worker"`
+	Proxy    string  `json:"proxy"`
+	Reason   string  `json:"reason"` // see FailureReason
+	Error    string  `json:"error"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration"`
+}
+
+// ProxyFailedEvent is sent when a worker gives up on a proxy and switches to the next one.
+type ProxyFailedEvent struct {
+	Worker string `json:"worker"`
+	Proxy  string `json:"proxy"`
+	Reason string `json:"reason"`
+}
+
+// ProgressEvent is sent every second while downloading.
+type ProgressEvent struct {
+	Downloaded     int64   `json:"downloaded"`
+	Total          int64   `json:"total"` // -1 if unknown
+	Speed          float64 `json:"speed"` // bytes per second
+	PartsCompleted int     `json:"parts_completed"`
+	PartsTotal     int     `json:"parts_total"`
+}
+
+// FinishedEvent is sent at the end of the download.
+type FinishedEvent struct {
+	Success  bool    `json:"success"`
+	Path     string  `json:"path"`
+	Size     int64   `json:"size"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// OpenEventWriter creates an event writer to path, or to stdout if path is "-".
+func OpenEventWriter(path string) (*EventWriter, error) {
+	file := os.Stdout
+	if path != "-" {
+		var err error
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &EventWriter{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Emit writes an event of the given type, data is one of the *Event structs.
+func (e *EventWriter) Emit(eventType string, data any) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_ = e.enc.Encode(event{Version: eventsVersion, Type: eventType, Time: time.Now().UTC(), Data: data})
+}
+
+// Close closes the event file.
+func (e *EventWriter) Close() error {
+	if e == nil || e.file == os.Stdout {
+		return nil
+	}
+	return e.file.Close()
+}
+
+// errorString returns the message of err, or "" if err is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
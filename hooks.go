@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Lifecycle events sent to the webhook, in the envelope of the event stream.
+const (
+	HookDownloadStarted   = EventDownloadStarted
+	HookDownloadCompleted = "download_completed"
+	HookDownloadFailed    = "download_failed"
+)
+
+// webhookTimeout is the timeout of a single webhook request.
+const webhookTimeout = 10 * time.Second
+
+// hooks runs the commands and webhook of the download lifecycle, nil if none is configured.
+var hooks *Hooks
+
+// Hooks runs commands and posts to a webhook when downloads start and finish.
+// All methods can be called on nil hooks and do nothing.
+type Hooks struct {
+	OnComplete string // shell command run after a successful download
+	OnError    string // shell command run after a failed download
+	Webhook    string // URL receiving the lifecycle events
+	Retries    int    // retries of a failed webhook request
+
+	client  *http.Client
+	pending sync.WaitGroup // started events still being sent
+}
+
+// HookResult describes a finished download. It is the payload of the completed and failed webhook events.
+type HookResult struct {
+	URL      string  `json:"url"`
+	Path     string  `json:"path"`
+	Size     int64   `json:"size"`
+	SHA256   string  `json:"sha256,omitempty"` // only for completed downloads
+	Duration float64 `json:"duration"`         // seconds
+	Error    string  `json:"error,omitempty"`
+}
+
+// NewHooks returns the hooks, or nil if neither a command nor a webhook is set.
+func NewHooks(onComplete, onError, webhook string, retries int) *Hooks {
+	if onComplete == "" && onError == "" && webhook == "" {
+		return nil
+	}
+	return &Hooks{
+		OnComplete: onComplete,
+		OnError:    onError,
+		Webhook:    webhook,
+		Retries:    retries,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			Transport: &http.Transport{
+				DialContext:     dialThroughUpstream(&net.Dialer{Timeout: time.Duration(connectTimeout) * time.Second}),
+				TLSClientConfig: proxyTLSConfig,
+			},
+		},
+	}
+}
+
+// Started posts the started event to the webhook in the background.
+func (h *Hooks) Started(data DownloadStartedEvent) {
+	if h == nil || h.Webhook == "" {
+		return
+	}
+	h.pending.Add(1)
+	go func() {
+		defer h.pending.Done()
+		h.post(HookDownloadStarted, data)
+	}()
+}
+
+// Finished runs the command and posts the webhook event for a download that completed, or failed with err.
+// It blocks until both are done.
+func (h *Hooks) Finished(url, path string, duration time.Duration, err error) {
+	if h == nil {
+		return
+	}
+	result := HookResult{URL: url, Path: path, Duration: duration.Seconds(), Error: errorString(err)}
+	if info, statErr := os.Stat(path); statErr == nil && err == nil {
+		result.Size = info.Size()
+		if result.SHA256, statErr = fileSHA256(path); statErr != nil {
+			log.Warn("Failed to compute the checksum.", "path", path, "err", statErr)
+		}
+	}
+
+	command, eventType := h.OnComplete, HookDownloadCompleted
+	if err != nil {
+		command, eventType = h.OnError, HookDownloadFailed
+	}
+	if command != "" {
+		h.run(command, result)
+	}
+	if h.Webhook != "" {
+		// The started event is sent first
+		h.pending.Wait()
+		h.post(eventType, result)
+	}
+}
+
+// run runs command with the result in MPD_* environment variables.
+func (h *Hooks) run(command string, result HookResult) {
+	cmd := shellCommand(context.Background(), command)
+	cmd.Env = append(os.Environ(),
+		"MPD_URL="+result.URL,
+		"MPD_PATH="+result.Path,
+		"MPD_SIZE="+strconv.FormatInt(result.Size, 10),
+		"MPD_SHA256="+result.SHA256,
+		"MPD_DURATION="+strconv.FormatFloat(result.Duration, 'f', 3, 64),
+		"MPD_ERROR="+result.Error,
+	)
+	cmd.Stdout = consoleOut
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Error("Hook command failed.", "command", command, "err", err)
+	}
+}
+
+// post sends an event to the webhook, retrying with an increasing delay.
+func (h *Hooks) post(eventType string, data any) {
+	body, err := json.Marshal(event{Version: eventsVersion, Type: eventType, Time: time.Now().UTC(), Data: data})
+	if err != nil {
+		log.Error("Failed to encode webhook event.", "err", err)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = h.send(body)
+		if err == nil {
+			return
+		}
+		if attempt >= h.Retries {
+			log.Error("Webhook failed.", "event", eventType, "err", err)
+			return
+		}
+		delay := time.Second << attempt
+		log.Warn("Webhook failed. Retrying...", "event", eventType, "err", err, "in", delay)
+		time.Sleep(delay)
+	}
+}
+
+// send posts body to the webhook once.
+func (h *Hooks) send(body []byte) error {
+	resp, err := h.client.Post(h.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex SHA256 checksum of a file.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
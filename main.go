@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/charmbracelet/log"
-	"github.com/schollz/progressbar/v3"
 )
 
 var (
@@ -23,23 +27,135 @@ var (
 	maxConcurrentDownloads int
 	proxyMaxRetry          int
 	proxyTimeout           int
-	proxiesFilePath        string
+	connectTimeout         int
+	tlsTimeout             int
+	headerTimeout          int
+	minSpeed               int64
+	minSpeedTime           int
+	proxySources           = stringList{values: []string{"proxies.txt"}}
+	proxyTags              string
+	watchProxies           bool
+	gatewaySessions        int
+	maxConnsPerProxy       int
+	quarantineTime         int
+	useDirect              bool
+	directConns            int
+	directOnlyFallback     bool
+	bindAddrs              string
+	bindInterfaces         string
+	upstreamProxyAddr      string
+	pacLocation            string
+	reputationPath         string
+	printStats             bool
+	statsJSONPath          string
+	eventsPath             string
+	metricsAddr            string
+	controlAddr            string
+	listenAddr             string
+	concurrentJobs         int
+	queuePath              string
+	downloadDir            string
+	rpcSecret              string
+	rpcAllowOriginAll      bool
+	tuiMode                bool
+	onCompleteCommand      string
+	onErrorCommand         string
+	webhookURL             string
+	webhookRetries         int
+	noReputation           bool
 	verbose                bool
 	jsonOutput             bool
 	debug                  bool
 	debugProxy             bool
 	overwrite              bool
+
+	insecure       bool
+	caCertPath     string
+	certPath       string
+	keyPath        string
+	pins           string
+	tlsConfig      *tls.Config // for the download server
+	proxyTLSConfig *tls.Config // for proxies and all other servers
+
+	refreshCmd string
+	refreshURL string
 )
 
 const version = "1.1.0"
 
+// stringList is a flag that can be given multiple times.
+// The default value is replaced on first use.
+type stringList struct {
+	values []string
+	set    bool
+}
+
+func (l *stringList) String() string {
+	return strings.Join(l.values, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	if !l.set {
+		l.values = nil
+		l.set = true
+	}
+	l.values = append(l.values, value)
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reputation" {
+		os.Exit(runReputationCommand(os.Args[2:]))
+	}
+
+	// The serve command takes the same flags as a download, applied to all jobs
+	args := os.Args[1:]
+	serveMode := len(args) > 0 && args[0] == "serve"
+	if serveMode {
+		args = args[1:]
+		flag.StringVar(&listenAddr, "listen", "127.0.0.1:6800", "Address of the job API (or unix:/path/to.sock)")
+		flag.IntVar(&concurrentJobs, "jobs", 2, "Number of jobs downloaded at the same time")
+		flag.StringVar(&queuePath, "queue", "", "Path to the job queue file (default in the user cache directory)")
+		flag.StringVar(&downloadDir, "dir", ".", "Directory for downloaded files")
+		flag.StringVar(&rpcSecret, "rpc-secret", "", "Secret token required by the aria2 JSON-RPC interface and the job API")
+		flag.BoolVar(&rpcAllowOriginAll, "rpc-allow-origin-all", false, "Allow web pages of any origin to use the aria2 JSON-RPC interface")
+	}
+
 	flag.StringVar(&fileURL, "url", "", "URL of the file to download")
 	flag.StringVar(&outputPath, "output", "", "Path to save the downloaded file")
-	flag.StringVar(&proxiesFilePath, "proxy", "proxies.txt", "Path to a file containing a list of proxy addresses")
+	flag.Var(&proxySources, "proxy", "Proxy list source: a file, a directory of lists, - for stdin or an http(s) URL. Can be repeated")
+	flag.BoolVar(&watchProxies, "watch", false, "Reload the proxy list when a proxy list file changes (the list is always reloaded on SIGHUP)")
+	flag.IntVar(&gatewaySessions, "sessions", 10, "Number of virtual proxies created from each backconnect gateway template with a {rand} or {id} placeholder")
+	flag.StringVar(&proxyTags, "tag", "", "Comma separated list of tags, only proxies with any of them are used")
 	flag.IntVar(&maxConcurrentDownloads, "max", 30, "Maximum number of concurrent downloads")
+	flag.IntVar(&maxConnsPerProxy, "max-conns", 1, "Maximum number of concurrent downloads through one proxy (can be set per proxy with max_conns)")
+	flag.IntVar(&quarantineTime, "quarantine", 10, "Time in seconds a failed proxy is not used, doubled with each consecutive failure (0 to disable)")
+	flag.BoolVar(&useDirect, "direct", false, "Use the direct connection (without proxy) alongside the proxies")
+	flag.IntVar(&directConns, "direct-conns", 4, "Maximum number of concurrent downloads through the direct connection and each -bind address")
+	flag.BoolVar(&directOnlyFallback, "direct-only-fallback", false, "Use the direct connection only when all proxies are quarantined (implies -direct)")
+	flag.StringVar(&bindAddrs, "bind", "", "Comma-separated local IPs to download from directly, each used as a pool member")
+	flag.StringVar(&bindInterfaces, "interface", "", "Comma-separated network interfaces whose addresses are used like -bind")
+	flag.StringVar(&upstreamProxyAddr, "upstream-proxy", "", "HTTP(S) proxy that all connections, including those to the pool proxies, are tunneled through")
+	flag.StringVar(&pacLocation, "pac", "", "PAC file (path or http(s) URL) used to select the proxy for each URL, added as a pool member")
+	flag.StringVar(&reputationPath, "reputation", "", "Path to the proxy reputation database (default in the user cache directory)")
+	flag.BoolVar(&noReputation, "no-reputation", false, "Do not use or update the proxy reputation database")
+	flag.BoolVar(&printStats, "stats", false, "Print per-proxy and per-worker statistics at the end of the download")
+	flag.StringVar(&statsJSONPath, "stats-json", "", "Write per-proxy and per-worker statistics as JSON to this file (- for stdout)")
+	flag.StringVar(&eventsPath, "events", "", "Write a versioned NDJSON event stream to this file (- for stdout)")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Expose Prometheus metrics on this address (e.g. :9100)")
+	flag.StringVar(&controlAddr, "control-addr", "", "Serve a JSON API to control the running download on this address (or unix:/path/to.sock)")
+	flag.BoolVar(&tuiMode, "tui", false, "Show a full-screen view with the workers and parts instead of the progress bar")
+	flag.StringVar(&onCompleteCommand, "on-complete", "", "Shell command to run after a successful download, with MPD_URL, MPD_PATH, MPD_SIZE, MPD_SHA256 and MPD_DURATION set")
+	flag.StringVar(&onErrorCommand, "on-error", "", "Shell command to run after a failed download, with MPD_URL, MPD_PATH, MPD_DURATION and MPD_ERROR set")
+	flag.StringVar(&webhookURL, "webhook", "", "URL to POST a JSON event to when a download starts, completes or fails")
+	flag.IntVar(&webhookRetries, "webhook-retries", 3, "Number of retries for a failed webhook request")
 	flag.IntVar(&proxyMaxRetry, "retry", 2, "Number of retries for a part before switching to the next proxy")
 	flag.IntVar(&proxyTimeout, "timeout", 20, "Timeout in seconds for inactivity before switching proxy")
+	flag.IntVar(&connectTimeout, "connect-timeout", 5, "Timeout in seconds for establishing a TCP connection")
+	flag.IntVar(&tlsTimeout, "tls-timeout", 5, "Timeout in seconds for the TLS handshake")
+	flag.IntVar(&headerTimeout, "header-timeout", 5, "Timeout in seconds for receiving the response headers")
+	flag.Int64Var(&minSpeed, "min-speed", 0, "Minimum download speed in KB/s per connection before switching proxy (0 to disable)")
+	flag.IntVar(&minSpeedTime, "min-speed-time", 15, "Period in seconds over which the minimum download speed is measured")
 	partSizeFlag := flag.Int("part", 10, "Size of each download part in megabytes (MB)")
 	flag.BoolVar(&verbose, "verbose", false, "Disable the progress bar and show logs instead")
 	flag.BoolVar(&jsonOutput, "json-output", false, "Enable JSON formatted output for logs (automatically enables --verbose, reports progress every 5s)")
@@ -47,11 +163,21 @@ func main() {
 	flag.BoolVar(&debugProxy, "debug-proxy", false, "Enable debug logging for proxy operations")
 	versionFlag := flag.Bool("v", false, "Display the application version and exit")
 	flag.BoolVar(&overwrite, "overwrite", false, "Overwrite the output file if it already exists")
-	flag.Parse()
+	flag.BoolVar(&insecure, "insecure", false, "Disable TLS certificate verification")
+	flag.StringVar(&caCertPath, "cacert", "", "Path to a PEM file with additional trusted CA certificates")
+	flag.StringVar(&certPath, "cert", "", "Path to a PEM client certificate for mutual TLS")
+	flag.StringVar(&keyPath, "key", "", "Path to the PEM private key of the client certificate")
+	flag.StringVar(&pins, "pin", "", "Comma separated list of base64 SHA-256 server public key hashes to pin (sha256//<hash>)")
+	flag.StringVar(&refreshCmd, "refresh-cmd", "", "Command that prints a fresh download URL, run when the link expires (403/410)")
+	flag.StringVar(&refreshURL, "refresh-url", "", "Endpoint that returns a fresh download URL as plain text or JSON {\"url\": ...}, requested when the link expires (403/410)")
+	flag.CommandLine.Parse(args)
 
 	if jsonOutput {
 		verbose = true
 	}
+	if directOnlyFallback {
+		useDirect = true
+	}
 
 	if *versionFlag {
 		fmt.Println("multi-proxy-downloader version:", version)
@@ -78,371 +204,281 @@ func main() {
 	fileURL = strings.TrimSpace(fileURL)
 	outputPath = strings.TrimSpace(outputPath)
 
-	if fileURL == "" {
+	if fileURL == "" && !serveMode {
 		fmt.Println("Usage: multi-proxy-downloader --url <url>")
 		fmt.Println("Available arguments can be checked with -h or --help")
 		os.Exit(0)
 	}
 
-	log.Debug("", "Part size", strconv.Itoa(int(partSizeBytes/(1024*1024)))+" MB")
-	log.Debug("", "Max concurrent connections", strconv.Itoa(maxConcurrentDownloads))
-	log.Debug("", "Max retries per proxy", strconv.Itoa(proxyMaxRetry))
-
-	// Load proxies list from text file
-	proxiesAbsFilePath, err := filepath.Abs(proxiesFilePath)
-	if err != nil {
-		log.Fatal("Failed to get absolute path to proxy list file:", "err", err)
+	// Machine readable event stream
+	if eventsPath != "" {
+		if eventsPath == "-" && statsJSONPath == "-" {
+			log.Fatal("The event stream and the statistics cannot both be written to stdout.")
+		}
+		var err error
+		events, err = OpenEventWriter(eventsPath)
+		if err != nil {
+			log.Fatal("Error opening event stream!", "err", err)
+		}
+		defer events.Close()
+		if eventsPath == "-" {
+			consoleOut = os.Stderr
+		}
 	}
-	log.Debug("", "Proxy list file", proxiesAbsFilePath)
 
-	proxies, err := ReadLines(proxiesAbsFilePath)
+	// TLS settings
+	if serveMode && pins != "" {
+		log.Fatal("Certificate pins are not supported in daemon mode, the jobs can download from any server.")
+	}
+	var err error
+	tlsConfig, proxyTLSConfig, err = NewTLSConfig(TLSOptions{
+		Insecure:   insecure,
+		CACertPath: caCertPath,
+		CertPath:   certPath,
+		KeyPath:    keyPath,
+		Pins:       strings.Split(pins, ","),
+		PinHost:    hostnameOf(fileURL),
+	})
 	if err != nil {
-		log.Fatal("Error reading proxy list file!", "err", err)
+		log.Fatal("Invalid TLS configuration.", "err", err)
 	}
-	log.Info("Loaded proxy list file.", "found addresses", len(proxies))
-
-	if maxConcurrentDownloads > len(proxies) {
-		maxConcurrentDownloads = len(proxies)
-		log.Error("Maximum concurrent connections cannot be greater than the number of available proxies.", "reduced to", strconv.Itoa(maxConcurrentDownloads))
+	if insecure {
+		log.Warn("TLS certificate verification is disabled.")
 	}
 
-	// Proxy queue
-	pool := NewProxyPool(proxies)
+	log.Debug("", "Part size", strconv.Itoa(int(partSizeBytes/(1024*1024)))+" MB")
+	log.Debug("", "Max concurrent connections", strconv.Itoa(maxConcurrentDownloads))
+	log.Debug("", "Max retries per proxy", strconv.Itoa(proxyMaxRetry))
+	log.Debug("", "Timeouts", fmt.Sprintf("connect=%ds tls=%ds header=%ds inactivity=%ds", connectTimeout, tlsTimeout, headerTimeout, proxyTimeout))
+	if minSpeed > 0 {
+		log.Debug("", "Minimum speed", fmt.Sprintf("%d KB/s over %ds", minSpeed, minSpeedTime))
+	}
 
-	// Get file lenght
-	// TODO: use proxy for this
-	var contentLength int64
-	var fileName string
-	var fileParts []FilePart
-	var retryCounter = 0
-	for {
-		if retryCounter >= 3 {
-			// fmt.Println("Error getting file content length:", err)
-			os.Exit(1)
+	// Upstream proxy for all connections
+	if upstreamProxyAddr != "" {
+		upstreamProxy, err = ParseUpstreamProxy(upstreamProxyAddr)
+		if err != nil {
+			log.Fatal("Invalid upstream proxy!", "err", err)
 		}
+		log.Debug("", "Upstream proxy", upstreamProxy.Redacted())
+	}
 
-		// if retryCounter >= proxyMaxRetry {
-		// 	retryCounter = 0
-		// 	_, err := pool.Fail("0")
-		// 	if err != nil {
-		// 		fmt.Println("Error getting proxy URL:", err)
-		// 		os.Exit(1)
-		// 	}
-		// }
-
-		// proxyURL, err := pool.Assign("0")
-		// if err != nil {
-		// 	fmt.Println("Error getting proxy URL:", err)
-		// 	os.Exit(1)
-		// }
+	// Hooks, the webhook is sent through the upstream proxy
+	hooks = NewHooks(onCompleteCommand, onErrorCommand, webhookURL, webhookRetries)
 
-		// contentLength, err = GetFileContentLength(fileURL, proxyURL)
+	// Local addresses for direct connections
+	localAddrs, err := LocalAddresses(bindAddrs, bindInterfaces)
+	if err != nil {
+		log.Fatal("Error reading local addresses!", "err", err)
+	}
+	if len(localAddrs) > 0 {
+		log.Debug("", "Local addresses", strings.Join(localAddrs, ","))
+	}
 
-		contentLength, fileName, err = GetFileInfo(fileURL, "")
+	// PAC file selecting the proxy for each URL
+	var pac *PACScript
+	if pacLocation != "" {
+		pac, err = LoadPAC(pacLocation)
 		if err != nil {
-			retryCounter++
-			log.Error("Error getting file content length.", "err", err)
-			continue
+			log.Fatal("Error reading PAC file!", "err", err)
 		}
+		probeProxy = pac.Proxy
+		log.Debug("", "PAC file", pacLocation)
+	}
+	hasLocal := useDirect || len(localAddrs) > 0 || pac != nil
 
-		// Calculate parts
-		fileParts = DivideFileIntoParts(contentLength, partSizeBytes)
-
-		log.Info("Fetched file info.", "name", fileName, "length", contentLength, "size", fmt.Sprintf("%d MB", contentLength/(1024*1024)), "parts", len(fileParts))
-		break
+	// Load proxies list from all sources
+	log.Debug("", "Proxy list sources", proxySources.String())
+	useEnvironment := false
+	proxies, err := LoadProxySources(proxySources.values)
+	if err != nil {
+		// Without the default proxy list the local connections or the environment proxy settings are used
+		if proxySources.set || !errors.Is(err, fs.ErrNotExist) {
+			log.Fatal("Error reading proxy list!", "err", err)
+		}
+		if hasLocal {
+			log.Debug("Default proxy list not found, using only the local connections.")
+		} else {
+			log.Info("Proxy list not found, using the environment proxy settings.")
+			useEnvironment = true
+		}
 	}
+	log.Info("Loaded proxy list.", "found addresses", len(proxies))
 
-	// Determine output absolute path
-	if outputPath == "" {
-		outputPath = fileName
+	// Select proxies by tag
+	if proxyTags != "" {
+		proxies = FilterProxiesByTag(proxies, strings.Split(proxyTags, ","))
+		log.Info("Selected proxies by tag.", "tags", proxyTags, "found addresses", len(proxies))
 	}
-	absOutputPath, workDir, err := PrepareOutputPath(outputPath)
-	if err != nil {
-		log.Fatal("", "err", err)
+	if len(proxies) == 0 && !hasLocal && !useEnvironment {
+		log.Fatal("No proxy addresses available.")
 	}
-	log.Debug("", "Working directory", workDir)
-	log.Debug("", "Output file", absOutputPath)
 
-	// Check if the output file already exists
-	if _, err := os.Stat(absOutputPath); err == nil {
-		if !overwrite {
-			log.Error("File already exists. Use the --overwrite flag to overwrite it.", "path", absOutputPath)
-			os.Exit(0)
+	// Add the local connection as a pool member, or keep it as a fallback
+	for _, localAddr := range localAddrs {
+		proxies = append(proxies, NewDirectEntry(localAddr, directConns))
+	}
+	if pac != nil {
+		proxies = append(proxies, NewPACEntry(pac, directConns))
+	}
+	if useEnvironment {
+		proxies = append(proxies, NewEnvironmentEntry(directConns))
+	}
+	var fallback *ProxyEntry
+	if useDirect {
+		direct := NewDirectEntry("", directConns)
+		if directOnlyFallback && slices.ContainsFunc(proxies, func(proxy *ProxyEntry) bool { return !proxy.Local }) {
+			fallback = direct
+			log.Debug("", "Direct connection", "fallback")
+		} else {
+			proxies = append(proxies, direct)
+			log.Debug("", "Direct connection", "enabled")
 		}
 	}
 
-	// Check if contentLength changed when redownloading. If not redownloading then save it to file.
-	infoFilePath, err := SaveContentLengthToFile(workDir, filepath.Base(absOutputPath), contentLength)
-	if err != nil {
-		log.Fatal("", "err", err)
+	// Proxy statistics from previous runs
+	if !noReputation {
+		var err error
+		if reputationPath == "" {
+			reputationPath, err = DefaultReputationPath()
+		}
+		if err == nil {
+			reputation, err = LoadReputation(reputationPath)
+		}
+		if err != nil {
+			log.Warn("Proxy reputation database not available.", "err", err)
+		} else {
+			log.Debug("", "Reputation database", reputationPath)
+		}
 	}
 
-	// Check if the number of parts is less than the maximum concurrent downloads
-	if len(fileParts) < maxConcurrentDownloads {
-		maxConcurrentDownloads = len(fileParts)
-		log.Warn("Adjusting maximum concurrent connections to number of parts.")
+	// Proxy queue
+	pool := NewProxyPool(proxies)
+	pool.SetFallback(fallback)
+	if capacity := pool.Capacity(); maxConcurrentDownloads > capacity {
+		maxConcurrentDownloads = capacity
+		log.Error("Maximum concurrent connections cannot be greater than the connection limit of available proxies.", "reduced to", strconv.Itoa(maxConcurrentDownloads))
 	}
+	go WatchProxySources(pool, proxySources.values, proxies, watchProxies)
 
-	// Create a channel to pass the parts to download
-	partsChan := make(chan FilePart, len(fileParts))
-	for _, part := range fileParts {
-		partsChan <- part
+	// Prometheus metrics
+	if metricsAddr != "" {
+		if err := ServeMetrics(metricsAddr); err != nil {
+			log.Fatal("Error starting metrics endpoint!", "err", err)
+		}
+		metrics.RegisterGauge("mpd_proxy_queue_depth", "Proxies waiting in the queue.", func() float64 {
+			return float64(pool.QueueDepth())
+		})
+		metrics.RegisterCounter("mpd_proxy_rotations_total", "Times a worker switched away from a failing proxy.", func() float64 {
+			return float64(pool.ErrorCount())
+		})
+		log.Debug("", "Metrics endpoint", metricsAddr)
 	}
-	close(partsChan)
-
-	// Create a pool of workers (goroutines) for downloading
-	var wg sync.WaitGroup
-	wg.Add(maxConcurrentDownloads)
 
-	var mu sync.Mutex
-	var totalDownloaded int64
-	progressUpdateChan := make(chan struct{}, 1)
-
-	type dataPoint struct {
-		timestamp time.Time
-		bytes     int64
+	if serveMode {
+		Serve(pool)
+		pool.Close()
+		return
 	}
-	var history []dataPoint
 
-	calculateCurrentSpeed := func() float64 {
-		now := time.Now()
-		history = append(history, dataPoint{timestamp: now, bytes: totalDownloaded})
-		for len(history) > 0 && now.Sub(history[0].timestamp) > 10*time.Second {
-			history = history[1:]
-		}
-		if len(history) > 1 {
-			duration := history[len(history)-1].timestamp.Sub(history[0].timestamp).Seconds()
-			if duration > 0 {
-				return float64(history[len(history)-1].bytes-history[0].bytes) / duration
-			}
+	// The download can be controlled while running
+	download := NewDownload(pool, DownloadOptions{
+		URL:        fileURL,
+		Output:     outputPath,
+		Overwrite:  overwrite,
+		PartSize:   partSizeBytes,
+		MaxWorkers: maxConcurrentDownloads,
+		Quiet:      tuiMode,
+	})
+	if controlAddr != "" {
+		listener, err := ServeControl(controlAddr, download, pool)
+		if err != nil {
+			log.Fatal("Error starting control API!", "err", err)
 		}
-		return 0.0
+		defer listener.Close()
+		log.Debug("", "Control API", controlAddr)
 	}
 
-	// Periodic JSON reporting
-	if jsonOutput {
-		go func() {
-			ticker := time.NewTicker(5 * time.Second)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-ticker.C:
-					mu.Lock()
-					currentSpeed := calculateCurrentSpeed()
-					reportProgress(fileParts, totalDownloaded, currentSpeed, contentLength)
-					mu.Unlock()
-				case <-progressUpdateChan:
-					ticker.Reset(5 * time.Second)
-					mu.Lock()
-					currentSpeed := calculateCurrentSpeed()
-					reportProgress(fileParts, totalDownloaded, currentSpeed, contentLength)
-					mu.Unlock()
-				}
-			}
-		}()
-	}
-
-	// Progress bar
-	var bar *progressbar.ProgressBar
-	if verbose {
-		mu.Lock()
-		PrintDownloadStatus(fileParts, partSizeBytes, contentLength, totalDownloaded, 0)
-		mu.Unlock()
+	// SIGINT and SIGTERM cancel the download, so that the proxy statistics of the run
+	// are still saved. A second signal exits immediately
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		signal.Stop(stop)
+		log.Info("Stopping.")
+		download.Cancel()
+	}()
+
+	if tuiMode {
+		err = RunTUI(download, pool)
 	} else {
-		bar = progressbar.NewOptions(int(contentLength),
-			progressbar.OptionSetMaxDetailRow(1),
-			progressbar.OptionShowCount(),
-			progressbar.OptionEnableColorCodes(true),
-			progressbar.OptionShowBytes(true),
-			progressbar.OptionFullWidth(),
-			progressbar.OptionSetDescription("Downloading:"),
-			progressbar.OptionSetTheme(progressbar.Theme{
-				Saucer:        lipgloss.NewStyle().Foreground(lipgloss.Color("86")).Render("━"),
-				SaucerHead:    lipgloss.NewStyle().Foreground(lipgloss.Color("86")).Render("━"),
-				SaucerPadding: " ",
-				BarStart:      "┃",
-				BarEnd:        "┃",
-			}))
-	}
-
-	for i := 0; i < maxConcurrentDownloads; i++ {
-		go func(workerID int) {
-			defer wg.Done()
-			for part := range partsChan {
-				partFileName := fmt.Sprintf("%s.%d.part", filepath.Base(absOutputPath), part.Number)
-				partAbsPath := filepath.Join(workDir, partFileName)
-				partSize := part.End - part.Start + 1
-
-				// Check if the part file already exists and has the correct size
-				fileInfo, err := os.Stat(partAbsPath)
-				if err == nil {
-					if fileInfo.Size() == partSize {
-						if !verbose {
-							bar.Add(int(partSize))
-						}
-						mu.Lock()
-						fileParts[part.Number].Downloaded = true
-						totalDownloaded += partSize
-						if verbose {
-							if jsonOutput {
-								select {
-								case progressUpdateChan <- struct{}{}:
-								default:
-								}
-							} else {
-								PrintDownloadStatus(fileParts, partSizeBytes, contentLength, totalDownloaded, calculateCurrentSpeed())
-							}
-						} else {
-							bar.AddDetail(DetailsPrompt(fileParts, pool.errorCount))
-						}
-						mu.Unlock()
-						continue
-					} else {
-						err := os.Remove(partAbsPath)
-						if err != nil {
-							log.Error("Error deleting part.", "path", partAbsPath, "err", err)
-						}
-					}
-
-				}
-
-				var retryCounter = 0
-				var proxyURL string
-				for {
-					if (retryCounter >= proxyMaxRetry && proxyMaxRetry != 0) || (retryCounter > proxyMaxRetry && proxyMaxRetry == 0) {
-						retryCounter = 0
-						proxyURL, err = pool.Fail(strconv.Itoa(workerID))
-						if err != nil {
-							log.Fatal("Error getting proxy URL.", "err", err)
-						}
-					} else {
-						proxyURL, err = pool.Assign(strconv.Itoa(workerID))
-						if err != nil {
-							log.Fatal("Error getting proxy URL.", "err", err)
-						}
-					}
-
-					var localDownloaded int64
-					downloadedBytes, err := DownloadPartialFile(fileURL, proxyURL, partAbsPath, part.Start, part.End, bar, time.Duration(proxyTimeout)*time.Second, func(n int64) {
-						mu.Lock()
-						totalDownloaded += n
-						localDownloaded += n
-						mu.Unlock()
-					})
-					if err != nil {
-						if verbose && debugProxy {
-							log.Debug(fmt.Sprintf("Worker %d: Error downloading part %d.", workerID, part.Number), "err", err)
-						}
-						_ = os.Remove(partAbsPath)
-
-						if !verbose {
-							bar.Add(-int(downloadedBytes))
-						}
-
-						// Reset global counter for the failed part
-						mu.Lock()
-						totalDownloaded -= localDownloaded
-						mu.Unlock()
-
-						// Retry indefinitely
-						retryCounter++
-						continue
-					}
-
-					// Verify the size of the downloaded part
-					fileInfo, err = os.Stat(partAbsPath)
-					if err != nil {
-						if verbose {
-							log.Error("Failed to get file part info", "worker id", workerID, "part path", partAbsPath, "err", err)
-						}
-
-						if !verbose {
-							bar.Add(-int(downloadedBytes))
-						}
-
-						mu.Lock()
-						totalDownloaded -= localDownloaded
-						mu.Unlock()
-
-						retryCounter++
-						continue
-					}
-
-					if fileInfo.Size() != partSize {
-						if verbose {
-							log.Warn(" Part has incorrect size. Redownloading.", "worker id", workerID, "part path", partAbsPath, "current size", fileInfo.Size(), "correct size", part.End-part.Start+1)
-						}
-
-						err := os.Remove(partAbsPath)
-						if err != nil {
-							log.Error("Failed to delete part.", "part path", partAbsPath, "err", err)
-						}
-						if !verbose {
-							bar.Add(-int(downloadedBytes))
-						}
-
-						mu.Lock()
-						totalDownloaded -= localDownloaded
-						mu.Unlock()
-
-						retryCounter++
-						continue
-					}
-
-					// Release proxy ip from the worker after succesful download
-					_ = pool.Release(strconv.Itoa(workerID))
-
-					mu.Lock()
-					fileParts[part.Number].Downloaded = true
-
-					if verbose {
-						if jsonOutput {
-							select {
-							case progressUpdateChan <- struct{}{}:
-							default:
-							}
-						} else {
-							PrintDownloadStatus(fileParts, partSizeBytes, contentLength, totalDownloaded, calculateCurrentSpeed())
-						}
-					} else {
-						bar.AddDetail(DetailsPrompt(fileParts, pool.errorCount))
-					}
-					mu.Unlock()
-					break
-				}
-			}
-		}(i)
-	}
-
-	// Wait for all workers
-	wg.Wait()
-	if !verbose {
-		bar.Finish()
-		fmt.Println("")
-	}
-	log.Debug("", "Proxy servers error count", pool.errorCount)
-	log.Info("All file parts downloaded. Concatenating file...")
-
-	// Concatenate parts into output file
-	err = ConcatenateFiles(absOutputPath, workDir)
+		err = download.Run()
+	}
+	absOutputPath := download.OutputPath()
+	if errors.Is(err, ErrOutputExists) {
+		log.Error("File already exists. Use the --overwrite flag to overwrite it.", "path", absOutputPath)
+		os.Exit(0)
+	}
+	pool.Close()
+	saveReputation()
+	log.Debug("", "Proxy servers error count", pool.ErrorCount())
+	if len(proxySources.values) > 1 {
+		log.Debug("", "Proxy errors by source", pool.SourceErrors())
+	}
+	log.Debug("", "New connections", connStats.NewConns(), "reused connections", connStats.ReusedConns(),
+		"average setup", connStats.AverageSetup().Round(time.Millisecond), "handshake time saved", connStats.TimeSaved().Round(time.Millisecond))
 	if err != nil {
-		log.Fatal("Error concatenating files:", "err", err)
+		reportStats(pool)
+		emitFinished(absOutputPath, err)
+		// Canceled downloads were stopped on purpose and do not run the hooks, like canceled jobs
+		if errors.Is(err, context.Canceled) {
+			log.Fatal("Download canceled, the downloaded parts are kept for the next run.")
+		}
+		hooks.Finished(fileURL, absOutputPath, runStats.Duration(), err)
+		log.Fatal("Download failed.", "err", err)
 	}
 	log.Print("File ready!", "path", absOutputPath)
+	reportStats(pool)
+	emitFinished(absOutputPath, nil)
+	hooks.Finished(fileURL, absOutputPath, runStats.Duration(), nil)
+}
 
-	// Verify the final file size
-	finalFileInfo, err := os.Stat(absOutputPath)
-	if err != nil {
-		log.Error("Couldn't read file", "err", err)
-	} else {
-		if finalFileInfo.Size() != contentLength {
-			log.Error("File size verification failed.", "size", finalFileInfo.Size(), "expected size", contentLength)
+// saveReputation writes the proxy statistics of this run to the reputation database.
+func saveReputation() {
+	if err := reputation.Save(); err != nil {
+		log.Warn("Failed to save proxy reputation database.", "err", err)
+	}
+}
+
+// reportStats prints and saves the statistics of this run if requested.
+func reportStats(pool *ProxyPool) {
+	report := runStats.Report()
+	if len(proxySources.values) > 1 {
+		report.Sources = make(map[string]int)
+		for source, errors := range pool.SourceErrors() {
+			report.Sources[redactProxy(source)] = errors
 		}
 	}
+	if printStats {
+		fmt.Fprintln(consoleOut, "")
+		report.Print(consoleOut)
+	}
+	if statsJSONPath != "" {
+		if err := report.WriteJSON(statsJSONPath); err != nil {
+			log.Error("Failed to write statistics.", "err", err)
+		}
+	}
+}
 
-	// Delete the info file
-	err = os.Remove(infoFilePath)
-	if err != nil {
-		log.Error("Error deleting info file.", "err", err)
+// emitFinished sends the finished event with the size of the output file.
+func emitFinished(path string, err error) {
+	if events == nil {
+		return
+	}
+	var size int64
+	if info, statErr := os.Stat(path); statErr == nil {
+		size = info.Size()
 	}
+	events.Emit(EventFinished, FinishedEvent{Success: err == nil, Path: path, Size: size, Duration: runStats.Duration().Seconds(), Error: errorString(err)})
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throughputBuckets are the upper bounds in bytes per second of the per-proxy throughput histogram.
+var throughputBuckets = []float64{64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20}
+
+// Metrics collects the metrics exposed in the Prometheus text format on -metrics-addr.
+type Metrics struct {
+	mu         sync.Mutex
+	funcs      map[string]metricFunc
+	received   int64                 // all bytes received, including failed parts
+	failures   map[string]int64      // FailureReason -> count
+	throughput map[string]*histogram // proxy name -> part throughput
+}
+
+type metricFunc struct {
+	kind string // gauge or counter
+	help string
+	fn   func() float64
+}
+
+type histogram struct {
+	counts []int64 // cumulative count per bucket of throughputBuckets
+	count  int64
+	sum    float64
+}
+
+var metrics = &Metrics{
+	funcs:      make(map[string]metricFunc),
+	failures:   make(map[string]int64),
+	throughput: make(map[string]*histogram),
+}
+
+// RegisterGauge exposes the value returned by fn as a gauge. A metric registered
+// again under the same name replaces the previous one.
+func (m *Metrics) RegisterGauge(name, help string, fn func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.funcs[name] = metricFunc{kind: "gauge", help: help, fn: fn}
+}
+
+// RegisterCounter exposes the value returned by fn as a counter, fn must never decrease.
+func (m *Metrics) RegisterCounter(name, help string, fn func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.funcs[name] = metricFunc{kind: "counter", help: help, fn: fn}
+}
+
+// AddReceived counts bytes received from the server.
+func (m *Metrics) AddReceived(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received += n
+}
+
+// observeAttempt counts a failed attempt by reason, or the throughput of a completed part.
+func (m *Metrics) observeAttempt(proxy string, bytes int64, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.failures[FailureReason(err)]++
+		return
+	}
+	if elapsed <= 0 {
+		return
+	}
+
+	h, ok := m.throughput[proxy]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(throughputBuckets))}
+		m.throughput[proxy] = h
+	}
+	speed := float64(bytes) / elapsed.Seconds()
+	for i, bound := range throughputBuckets {
+		if speed <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += speed
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	funcs := maps.Clone(m.funcs)
+	m.mu.Unlock()
+
+	// Metric functions may take other locks, so they are called without holding ours
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(funcs)) {
+		metric := funcs[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, metric.help, name, metric.kind, name, formatFloat(metric.fn()))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b.WriteString("# HELP mpd_received_bytes_total Bytes received from the server, including parts that failed.\n")
+	b.WriteString("# TYPE mpd_received_bytes_total counter\n")
+	fmt.Fprintf(&b, "mpd_received_bytes_total %d\n", m.received)
+
+	b.WriteString("# HELP mpd_proxy_failures_total Failed download attempts by reason.\n")
+	b.WriteString("# TYPE mpd_proxy_failures_total counter\n")
+	for _, reason := range slices.Sorted(maps.Keys(m.failures)) {
+		fmt.Fprintf(&b, "mpd_proxy_failures_total{reason=%s} %d\n", strconv.Quote(reason), m.failures[reason])
+	}
+
+	b.WriteString("# HELP mpd_proxy_throughput_bytes_per_second Download speed of completed parts by proxy.\n")
+	b.WriteString("# TYPE mpd_proxy_throughput_bytes_per_second histogram\n")
+	for _, proxy := range slices.Sorted(maps.Keys(m.throughput)) {
+		h := m.throughput[proxy]
+		label := "proxy=" + strconv.Quote(redactProxy(proxy))
+		for i, bound := range throughputBuckets {
+			fmt.Fprintf(&b, "mpd_proxy_throughput_bytes_per_second_bucket{%s,le=\"%s\"} %d\n", label, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(&b, "mpd_proxy_throughput_bytes_per_second_bucket{%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(&b, "mpd_proxy_throughput_bytes_per_second_sum{%s} %s\n", label, formatFloat(h.sum))
+		fmt.Fprintf(&b, "mpd_proxy_throughput_bytes_per_second_count{%s} %d\n", label, h.count)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeMetrics starts the metrics endpoint on addr in the background.
+func ServeMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.WriteTo(w)
+	})
+	go http.Serve(listener, mux)
+	return nil
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
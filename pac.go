@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// pacTimeout limits downloading a PAC file from a URL.
+const pacTimeout = 30 * time.Second
+
+// PACScript evaluates a proxy auto-config file to select the proxy for each URL.
+type PACScript struct {
+	mu   sync.Mutex // the JavaScript runtime is not safe for concurrent use
+	vm   *goja.Runtime
+	find goja.Callable
+}
+
+// LoadPAC reads a PAC file from a local path or an http(s) URL.
+func LoadPAC(location string) (*PACScript, error) {
+	var source []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		source, err = fetchPAC(location)
+	} else {
+		source, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewPACScript(string(source))
+}
+
+func fetchPAC(pacURL string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: pacTimeout,
+		Transport: &http.Transport{
+			DialContext:     dialThroughUpstream(&net.Dialer{Timeout: time.Duration(connectTimeout) * time.Second}),
+			TLSClientConfig: proxyTLSConfig,
+		},
+	}
+
+	resp, err := client.Get(pacURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned non-200 status: %v", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// NewPACScript compiles a PAC file. It must define FindProxyForURL(url, host).
+func NewPACScript(source string) (*PACScript, error) {
+	vm := goja.New()
+	vm.Set("dnsResolve", pacDNSResolve)
+	vm.Set("myIpAddress", pacMyIPAddress)
+	vm.Set("isInNet", pacIsInNet)
+	if _, err := vm.RunString(pacUtils); err != nil {
+		return nil, err
+	}
+	if _, err := vm.RunString(source); err != nil {
+		return nil, fmt.Errorf("invalid PAC file: %w", err)
+	}
+
+	find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, errors.New("invalid PAC file: FindProxyForURL is not defined")
+	}
+	return &PACScript{vm: vm, find: find}, nil
+}
+
+// FindProxy returns the raw result of FindProxyForURL, e.g. "PROXY host:port; DIRECT".
+func (p *PACScript) FindProxy(rawURL, host string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result, err := p.find(goja.Undefined(), p.vm.ToValue(rawURL), p.vm.ToValue(host))
+	if err != nil {
+		return "", fmt.Errorf("PAC file: %w", err)
+	}
+	return result.String(), nil
+}
+
+// Proxy selects the proxy for the request, it can be used as http.Transport.Proxy.
+// A nil URL means a direct connection.
+func (p *PACScript) Proxy(req *http.Request) (*url.URL, error) {
+	result, err := p.FindProxy(req.URL.String(), req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	return parsePACResult(result)
+}
+
+// parsePACResult returns the first usable proxy of a FindProxyForURL result.
+// Unsupported proxy types (e.g. SOCKS4) are skipped.
+func parsePACResult(result string) (*url.URL, error) {
+	for directive := range strings.SplitSeq(result, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			return nil, nil
+		}
+		if len(fields) != 2 {
+			continue
+		}
+
+		var scheme string
+		switch kind {
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			continue
+		}
+		return &url.URL{Scheme: scheme, Host: fields[1]}, nil
+	}
+	return nil, fmt.Errorf("PAC file returned no usable proxy: %q", result)
+}
+
+// pacDNSResolve returns the first IPv4 address of host, or null if it cannot be resolved.
+func pacDNSResolve(host string) any {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String()
+		}
+	}
+	return nil
+}
+
+// pacMyIPAddress returns the local IP used for outgoing connections.
+// No packets are sent, dialing UDP only selects the route.
+func pacMyIPAddress() string {
+	conn, err := net.Dial("udp", "198.51.100.1:80")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// pacIsInNet reports whether host (a name or IPv4 address) is in the network given by pattern and mask.
+func pacIsInNet(host, pattern, mask string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		resolved, ok := pacDNSResolve(host).(string)
+		if !ok {
+			return false
+		}
+		ip = net.ParseIP(resolved)
+	}
+
+	network, maskIP := net.ParseIP(pattern).To4(), net.ParseIP(mask).To4()
+	if ip.To4() == nil || network == nil || maskIP == nil {
+		return false
+	}
+	return ip.To4().Mask(net.IPMask(maskIP)).Equal(network.Mask(net.IPMask(maskIP)))
+}
+
+// pacUtils defines the standard PAC helper functions that do not need the network.
+const pacUtils = `
+function isPlainHostName(host) {
+	return host.indexOf('.') < 0;
+}
+
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length && host.substring(host.length - domain.length) === domain;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+	return host === hostdom || hostdom.lastIndexOf(host + '.', 0) === 0;
+}
+
+function isResolvable(host) {
+	return dnsResolve(host) !== null;
+}
+
+function dnsDomainLevels(host) {
+	return host.split('.').length - 1;
+}
+
+function shExpMatch(str, shexp) {
+	var re = shexp.replace(/[.+^${}()|[\]\\]/g, '\\$&').replace(/\*/g, '.*').replace(/\?/g, '.');
+	return new RegExp('^' + re + '$').test(str);
+}
+
+function pacNow(args) {
+	return args[args.length - 1] === 'GMT';
+}
+
+function pacInRange(value, from, to) {
+	return from <= to ? value >= from && value <= to : value >= from || value <= to;
+}
+
+var pacDays = ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'];
+var pacMonths = ['JAN', 'FEB', 'MAR', 'APR', 'MAY', 'JUN', 'JUL', 'AUG', 'SEP', 'OCT', 'NOV', 'DEC'];
+
+function weekdayRange() {
+	var gmt = pacNow(arguments), now = new Date();
+	var day = gmt ? now.getUTCDay() : now.getDay();
+	var from = pacDays.indexOf(arguments[0]);
+	var to = arguments.length > 1 && arguments[1] !== 'GMT' ? pacDays.indexOf(arguments[1]) : from;
+	return from >= 0 && to >= 0 && pacInRange(day, from, to);
+}
+
+function timeRange() {
+	var gmt = pacNow(arguments), now = new Date();
+	var args = Array.prototype.slice.call(arguments, 0, gmt ? arguments.length - 1 : arguments.length);
+	var h = gmt ? now.getUTCHours() : now.getHours();
+	var m = gmt ? now.getUTCMinutes() : now.getMinutes();
+	var s = gmt ? now.getUTCSeconds() : now.getSeconds();
+	switch (args.length) {
+	case 1: return h === args[0];
+	case 2: return args[0] <= h && h < args[1];
+	case 4: return pacInRange(h * 60 + m, args[0] * 60 + args[1], args[2] * 60 + args[3]);
+	case 6: return pacInRange(h * 3600 + m * 60 + s, args[0] * 3600 + args[1] * 60 + args[2], args[3] * 3600 + args[4] * 60 + args[5]);
+	}
+	return false;
+}
+
+function dateRange() {
+	var gmt = pacNow(arguments), now = new Date();
+	var args = Array.prototype.slice.call(arguments, 0, gmt ? arguments.length - 1 : arguments.length);
+	var date = {
+		day: gmt ? now.getUTCDate() : now.getDate(),
+		month: gmt ? now.getUTCMonth() : now.getMonth(),
+		year: gmt ? now.getUTCFullYear() : now.getFullYear()
+	};
+	// Each argument is a day (1-31), a month name or a year, given as a single value or a range
+	var parts = args.map(function (arg) {
+		if (typeof arg === 'string') return { unit: 'month', value: pacMonths.indexOf(arg) };
+		return arg > 31 ? { unit: 'year', value: arg } : { unit: 'day', value: arg };
+	});
+	var value = function (parts) {
+		var v = 0;
+		parts.forEach(function (part) {
+			v += part.unit === 'year' ? part.value * 10000 : part.unit === 'month' ? part.value * 100 : part.value;
+		});
+		return v;
+	};
+	var current = function (parts) {
+		return value(parts.map(function (part) { return { unit: part.unit, value: date[part.unit] }; }));
+	};
+	if (parts.length === 1) return current(parts) === value(parts);
+	var half = parts.length / 2;
+	var from = parts.slice(0, half), to = parts.slice(half);
+	return pacInRange(current(from), value(from), value(to));
+}
+`
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParsePACResult(t *testing.T) {
+	tests := []struct {
+		result  string
+		want    string // proxy URL, "" for a direct connection
+		wantErr bool
+	}{
+		{result: "DIRECT", want: ""},
+		{result: "PROXY proxy.example.com:8080", want: "http://proxy.example.com:8080"},
+		{result: "proxy 1.2.3.4:3128; DIRECT", want: "http://1.2.3.4:3128"},
+		{result: "HTTP 1.2.3.4:3128", want: "http://1.2.3.4:3128"},
+		{result: "HTTPS secure.example.com:443", want: "https://secure.example.com:443"},
+		{result: "SOCKS 1.2.3.4:1080", want: "socks5://1.2.3.4:1080"},
+		{result: "SOCKS5 1.2.3.4:1080; PROXY 5.6.7.8:8080", want: "socks5://1.2.3.4:1080"},
+		{result: "SOCKS4 1.2.3.4:1080; PROXY 5.6.7.8:8080", want: "http://5.6.7.8:8080"},
+		{result: "  ;  PROXY 5.6.7.8:8080  ", want: "http://5.6.7.8:8080"},
+		{result: "SOCKS4 1.2.3.4:1080; DIRECT", want: ""},
+		{result: "PROXY; DIRECT", want: ""},
+
+		{result: "", wantErr: true},
+		{result: "SOCKS4 1.2.3.4:1080", wantErr: true},
+		{result: "PROXY", wantErr: true},
+		{result: "undefined", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.result, func(t *testing.T) {
+			got, err := parsePACResult(test.result)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			gotURL := ""
+			if got != nil {
+				gotURL = got.String()
+			}
+			if gotURL != test.want {
+				t.Errorf("got %q, want %q", gotURL, test.want)
+			}
+		})
+	}
+}
+
+func TestPACIsInNet(t *testing.T) {
+	tests := []struct {
+		host, pattern, mask string
+		want                bool
+	}{
+		{"10.1.2.3", "10.0.0.0", "255.0.0.0", true},
+		{"10.1.2.3", "10.1.0.0", "255.255.0.0", true},
+		{"10.2.2.3", "10.1.0.0", "255.255.0.0", false},
+		{"192.168.1.1", "192.168.1.1", "255.255.255.255", true},
+		{"192.168.1.2", "192.168.1.1", "255.255.255.255", false},
+		{"8.8.8.8", "0.0.0.0", "0.0.0.0", true},
+		{"10.1.2.3", "invalid", "255.0.0.0", false},
+		{"10.1.2.3", "10.0.0.0", "invalid", false},
+		{"2001:db8::1", "10.0.0.0", "255.0.0.0", false},
+	}
+
+	for _, test := range tests {
+		if got := pacIsInNet(test.host, test.pattern, test.mask); got != test.want {
+			t.Errorf("isInNet(%q, %q, %q) = %v, want %v", test.host, test.pattern, test.mask, got, test.want)
+		}
+	}
+}
+
+func TestPACHelpers(t *testing.T) {
+	script, err := NewPACScript(`function FindProxyForURL(url, host) { return "DIRECT"; }`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{`dnsDomainIs("www.example.com", ".example.com")`, "true"},
+		{`dnsDomainIs("www.example.com", "example.com")`, "true"},
+		{`dnsDomainIs("www.example.org", ".example.com")`, "false"},
+		{`dnsDomainIs("com", ".example.com")`, "false"},
+		{`isPlainHostName("intranet")`, "true"},
+		{`isPlainHostName("www.example.com")`, "false"},
+		{`localHostOrDomainIs("www", "www.example.com")`, "true"},
+		{`localHostOrDomainIs("www.example.com", "www.example.com")`, "true"},
+		{`localHostOrDomainIs("www.example.org", "www.example.com")`, "false"},
+		{`dnsDomainLevels("www.example.com")`, "2"},
+		{`dnsDomainLevels("intranet")`, "0"},
+		{`shExpMatch("http://example.com/file.iso", "*.iso")`, "true"},
+		{`shExpMatch("http://example.com/file.iso", "*.zip")`, "false"},
+		{`shExpMatch("a.b", "a?b")`, "true"},
+		{`shExpMatch("axb", "a.b")`, "false"},
+		{`isInNet("10.1.2.3", "10.0.0.0", "255.0.0.0")`, "true"},
+		{`weekdayRange("SUN", "SAT")`, "true"},
+		{`timeRange(0, 24)`, "true"},
+	}
+
+	for _, test := range tests {
+		value, err := script.vm.RunString(test.expression)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.expression, err)
+			continue
+		}
+		if got := value.String(); got != test.want {
+			t.Errorf("%s = %s, want %s", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestPACScriptProxy(t *testing.T) {
+	script, err := NewPACScript(`
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".internal.example.com")) {
+		return "DIRECT";
+	}
+	if (shExpMatch(url, "https://*")) {
+		return "SOCKS5 10.0.0.2:1080; DIRECT";
+	}
+	return "PROXY 10.0.0.1:3128; DIRECT";
+}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://intranet/file", ""},
+		{"http://files.internal.example.com/file", ""},
+		{"https://example.com/file", "socks5://10.0.0.2:1080"},
+		{"http://example.com/file", "http://10.0.0.1:3128"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy, err := script.Proxy(req)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.url, err)
+			continue
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.url, got, test.want)
+		}
+	}
+
+	if _, err := NewPACScript(`var x = 1;`); err == nil {
+		t.Error("expected an error for a PAC file without FindProxyForURL")
+	}
+	if _, err := NewPACScript(`function FindProxyForURL(url, host) {`); err == nil {
+		t.Error("expected an error for a PAC file with a syntax error")
+	}
+}
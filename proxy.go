@@ -2,42 +2,80 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"maps"
+	"math"
 	"math/rand"
+	"net/http"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/charmbracelet/log"
 )
 
 // ProxyPool manages a rotating pool of proxy addresses assigned to workers.
 type ProxyPool struct {
-	mu         sync.Mutex
-	queue      []string          // available proxies in FIFO order
-	assigned   map[string]string // workerID -> proxy
-	errorCount int
+	mu           sync.Mutex
+	queue        []*ProxyEntry           // available proxies in FIFO order
+	assigned     map[string]*ProxyEntry  // workerID -> proxy
+	entries      map[string]*ProxyEntry  // proxy key -> proxy, all proxies in the pool
+	clients      map[string]*http.Client // proxy name -> client with kept-alive connections
+	fallback     *ProxyEntry             // used only when all proxies are quarantined
+	errorCount   int
+	sourceErrors map[string]int // proxy list source -> error count
 }
 
+// maxQuarantineDoublings caps the exponential quarantine backoff (base * 2^5).
+const maxQuarantineDoublings = 5
+
 // NewProxyPool initializes a new pool with the given list of proxies.
-func NewProxyPool(proxies []string) *ProxyPool {
-	queue := make([]string, len(proxies))
+func NewProxyPool(proxies []*ProxyEntry) *ProxyPool {
+	queue := make([]*ProxyEntry, len(proxies))
 	copy(queue, proxies)
 
-	// Randomize queue order
-	rand.Shuffle(len(queue), func(i, j int) {
-		queue[i], queue[j] = queue[j], queue[i]
+	// Randomize queue order, proxies with a higher weight tend to be at the front.
+	// Each proxy gets a key -ln(u)/weight (exponential distribution) and the queue
+	// is sorted by it, which with equal weights is the same as a uniform shuffle.
+	// The weight is scaled by the success rate from previous runs and proxies that
+	// were failing at the end of the last run stay quarantined.
+	keys := make(map[*ProxyEntry]float64, len(queue))
+	for _, proxy := range queue {
+		keys[proxy] = -math.Log(1-rand.Float64()) / (float64(max(proxy.Weight, 1)) * reputation.Score(proxy))
+		reputation.Seed(proxy)
+	}
+	sort.Slice(queue, func(i, j int) bool {
+		return keys[queue[i]] < keys[queue[j]]
 	})
 
+	entries := make(map[string]*ProxyEntry, len(queue))
+	for _, proxy := range queue {
+		entries[proxy.key()] = proxy
+	}
+
 	return &ProxyPool{
-		queue:      queue,
-		assigned:   make(map[string]string),
-		errorCount: 0,
+		queue:        queue,
+		assigned:     make(map[string]*ProxyEntry),
+		entries:      entries,
+		clients:      make(map[string]*http.Client),
+		errorCount:   0,
+		sourceErrors: make(map[string]int),
 	}
 }
 
+// SetFallback sets the proxy used only when all other proxies are quarantined.
+func (p *ProxyPool) SetFallback(proxy *ProxyEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fallback = proxy
+}
+
 // Assign returns the proxy assigned to the given workerID.
 // If the worker has no proxy yet, assigns the next available one.
 // Returns an error if no proxies are available.
-func (p *ProxyPool) Assign(workerID string) (string, error) {
+func (p *ProxyPool) Assign(ctx context.Context, workerID string) (*ProxyEntry, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -47,12 +85,10 @@ func (p *ProxyPool) Assign(workerID string) (string, error) {
 	}
 
 	// Need to assign a new proxy
-	if len(p.queue) == 0 {
-		return "", errors.New("no proxies available")
+	proxy, err := p.waitLeaseLocked(ctx)
+	if err != nil {
+		return nil, err
 	}
-	// Pop from head of queue
-	proxy := p.queue[0]
-	p.queue = p.queue[1:]
 
 	// Record assignment
 	p.assigned[workerID] = proxy
@@ -63,8 +99,9 @@ func (p *ProxyPool) Assign(workerID string) (string, error) {
 }
 
 // Fail reports that the worker's proxy has failed.
-// It unassigns the proxy, requeues it at the end, and assigns a new one.
-func (p *ProxyPool) Fail(workerID string) (string, error) {
+// It unassigns the proxy, quarantines it, requeues it at the end, and assigns a new one.
+// The quarantine doubles with each consecutive failure of the proxy.
+func (p *ProxyPool) Fail(ctx context.Context, workerID string) (*ProxyEntry, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -72,28 +109,80 @@ func (p *ProxyPool) Fail(workerID string) (string, error) {
 	proxy, ok := p.assigned[workerID]
 	if !ok {
 		// No proxy to fail; simply assign new
-		return p.assignLocked(workerID)
+		return p.assignLocked(ctx, workerID)
 	}
 
 	p.errorCount++
+	p.sourceErrors[proxy.Source]++
 
 	// Remove assignment
 	delete(p.assigned, workerID)
+	proxy.active--
 
-	// Requeue failed proxy at end
-	p.queue = append(p.queue, proxy)
+	// Drop connections to the failed proxy, they are likely broken
+	p.evictClientLocked(proxy.String())
+
+	// Keep the proxy out of rotation for a while
+	proxy.failures++
+	if quarantineTime > 0 {
+		backoff := quarantineBackoff(proxy.failures)
+		proxy.quarantinedUntil = time.Now().Add(backoff)
+		if verbose && debugProxy {
+			log.Debug("Proxy quarantined.", "adress", proxy, "for", backoff)
+		}
+	}
+
+	// The proxy is still queued if it allows more than one worker. Gateway sessions
+	// are replaced by a new session instead of requeueing the dead one
+	p.dequeueLocked(proxy)
+	if proxy.Template != "" && !proxy.removed {
+		proxy.removed = true
+		proxy = proxy.NewSession()
+		p.entries[proxy.key()] = proxy
+		if verbose && debugProxy {
+			log.Debug("New gateway session minted.", "adress", proxy)
+		}
+	}
+
+	// Requeue failed proxy at end, unless it was removed from the list in the meantime
+	if !proxy.removed && proxy != p.fallback {
+		p.queue = append(p.queue, proxy)
+	}
 
 	// Assign next proxy
-	return p.assignLocked(workerID)
+	return p.assignLocked(ctx, workerID)
+}
+
+// Skip switches the worker to the next proxy without counting a failure.
+// The skipped proxy is requeued at the end without a quarantine.
+func (p *ProxyPool) Skip(ctx context.Context, workerID string) (*ProxyEntry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proxy, ok := p.assigned[workerID]
+	if !ok {
+		return p.assignLocked(ctx, workerID)
+	}
+	delete(p.assigned, workerID)
+	proxy.active--
+
+	if proxy.removed {
+		if proxy.active == 0 {
+			p.evictClientLocked(proxy.String())
+		}
+	} else if proxy != p.fallback {
+		p.dequeueLocked(proxy)
+		p.queue = append(p.queue, proxy)
+	}
+	return p.assignLocked(ctx, workerID)
 }
 
 // assignLocked assigns a proxy to workerID. Caller must hold lock.
-func (p *ProxyPool) assignLocked(workerID string) (string, error) {
-	if len(p.queue) == 0 {
-		return "", errors.New("no proxies available")
+func (p *ProxyPool) assignLocked(ctx context.Context, workerID string) (*ProxyEntry, error) {
+	proxy, err := p.waitLeaseLocked(ctx)
+	if err != nil {
+		return nil, err
 	}
-	proxy := p.queue[0]
-	p.queue = p.queue[1:]
 	p.assigned[workerID] = proxy
 	if verbose && debugProxy {
 		log.Debug("New proxy assigned to worker.", "worker id", workerID, "adress", proxy)
@@ -101,6 +190,76 @@ func (p *ProxyPool) assignLocked(workerID string) (string, error) {
 	return proxy, nil
 }
 
+// waitLeaseLocked leases a proxy, waiting while all proxies are quarantined or
+// used up to their connection limit, until ctx is canceled. Caller must hold lock,
+// which is released while waiting.
+func (p *ProxyPool) waitLeaseLocked(ctx context.Context) (*ProxyEntry, error) {
+	for {
+		if proxy := p.leaseLocked(); proxy != nil {
+			return proxy, nil
+		}
+		if len(p.entries) == 0 && p.fallback == nil {
+			return nil, errors.New("no proxies available")
+		}
+
+		p.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+		p.mu.Lock()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// leaseLocked takes the first proxy in the queue that is not quarantined for one more worker.
+// A proxy stays in the queue, moved to its end, until it is used by as many
+// workers as its connection limit allows. If all proxies are quarantined, the fallback
+// is used. Proxies removed from the pool while queued are dropped. Returns nil if no
+// proxy is available. Caller must hold lock.
+func (p *ProxyPool) leaseLocked() *ProxyEntry {
+	p.queue = slices.DeleteFunc(p.queue, func(proxy *ProxyEntry) bool {
+		return proxy.removed
+	})
+
+	now := time.Now()
+	index := slices.IndexFunc(p.queue, func(proxy *ProxyEntry) bool {
+		return !now.Before(proxy.quarantinedUntil)
+	})
+
+	if index == -1 {
+		if len(p.queue) > 0 && p.fallback != nil && p.fallback.active < proxyConnLimit(p.fallback) {
+			p.fallback.active++
+			return p.fallback
+		}
+		return nil
+	}
+
+	// Pop from the queue
+	proxy := p.queue[index]
+	p.queue = slices.Delete(p.queue, index, index+1)
+
+	proxy.active++
+	if proxy.active < proxyConnLimit(proxy) {
+		p.queue = append(p.queue, proxy)
+	}
+	return proxy
+}
+
+// dequeueLocked removes the proxy from the queue if it is there. Caller must hold lock.
+func (p *ProxyPool) dequeueLocked(proxy *ProxyEntry) {
+	p.queue = slices.DeleteFunc(p.queue, func(queued *ProxyEntry) bool {
+		return queued == proxy
+	})
+}
+
+// quarantineBackoff returns how long a proxy with the given number of consecutive failures is quarantined.
+func quarantineBackoff(failures int) time.Duration {
+	return time.Duration(quarantineTime) * time.Second << min(max(failures-1, 0), maxQuarantineDoublings)
+}
+
 // Release frees the proxy assigned to a worker without requeueing.
 // Use this if a worker finishes normally.
 func (p *ProxyPool) Release(workerID string) error {
@@ -113,8 +272,209 @@ func (p *ProxyPool) Release(workerID string) error {
 	}
 	// Remove assignment
 	delete(p.assigned, workerID)
+	proxy.active--
+	proxy.failures = 0
+
+	// The fallback is not part of the queue
+	if proxy == p.fallback {
+		return nil
+	}
+
+	// Proxies removed from the list are dropped after finishing their part
+	if proxy.removed {
+		if proxy.active == 0 {
+			p.evictClientLocked(proxy.String())
+		}
+		return nil
+	}
 
 	// Return back to the start of the queue
-	p.queue = append([]string{proxy}, p.queue...)
+	p.dequeueLocked(proxy)
+	p.queue = append([]*ProxyEntry{proxy}, p.queue...)
 	return nil
 }
+
+// QueueDepth returns the number of proxies waiting in the queue.
+func (p *ProxyPool) QueueDepth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// ErrorCount returns how many times a proxy was failed and rotated.
+func (p *ProxyPool) ErrorCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.errorCount
+}
+
+// SourceErrors returns the number of proxy failures of each proxy list source.
+func (p *ProxyPool) SourceErrors() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return maps.Clone(p.sourceErrors)
+}
+
+// Capacity returns how many workers the pool can serve at once.
+func (p *ProxyPool) Capacity() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	capacity := 0
+	for _, proxy := range p.entries {
+		capacity += proxyConnLimit(proxy)
+	}
+	return capacity
+}
+
+// proxyConnLimit returns the maximum number of workers that may use the proxy at once.
+func proxyConnLimit(proxy *ProxyEntry) int {
+	if proxy.MaxConns > 0 {
+		return proxy.MaxConns
+	}
+	return max(maxConnsPerProxy, 1)
+}
+
+// Update replaces the proxy list of a running pool. New proxies are added to the end
+// of the queue. Removed proxies are taken out of the queue, but workers currently
+// using them keep them until they release them after the current part.
+func (p *ProxyPool) Update(proxies []*ProxyEntry) (added, removed int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	updated := make(map[string]bool, len(proxies))
+	for _, proxy := range proxies {
+		updated[proxy.key()] = true
+		if _, ok := p.entries[proxy.key()]; ok {
+			continue
+		}
+		reputation.Seed(proxy)
+		p.entries[proxy.key()] = proxy
+		p.queue = append(p.queue, proxy)
+		added++
+	}
+
+	for key, proxy := range p.entries {
+		// Local connections and proxies added through the control API are not part of the list
+		if updated[key] || proxy.Local || proxy.Source == apiSource {
+			continue
+		}
+		proxy.removed = true
+		delete(p.entries, key)
+		p.dequeueLocked(proxy)
+		removed++
+	}
+
+	return added, removed
+}
+
+// Add adds proxies to the end of the queue, skipping those already in the pool.
+func (p *ProxyPool) Add(proxies []*ProxyEntry) (added int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, proxy := range proxies {
+		if _, ok := p.entries[proxy.key()]; ok {
+			continue
+		}
+		reputation.Seed(proxy)
+		p.entries[proxy.key()] = proxy
+		p.queue = append(p.queue, proxy)
+		added++
+	}
+	return added
+}
+
+// ProxyStatus is the state of a proxy in the pool.
+type ProxyStatus struct {
+	Proxy            string     `json:"proxy"`
+	Source           string     `json:"source"`
+	Active           int        `json:"active"`
+	MaxConns         int        `json:"max_conns"`
+	Failures         int        `json:"failures"`
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"`
+	Queued           bool       `json:"queued"`
+	Template         string     `json:"template,omitempty"` // gateway template of a session
+}
+
+// Snapshot returns the state of all proxies in the pool, in queue order first.
+func (p *ProxyPool) Snapshot() []ProxyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	status := func(proxy *ProxyEntry, queued bool) ProxyStatus {
+		s := ProxyStatus{
+			Proxy:    redactProxy(proxy.String()),
+			Source:   proxy.Source,
+			Active:   proxy.active,
+			MaxConns: proxyConnLimit(proxy),
+			Failures: proxy.failures,
+			Queued:   queued,
+			Template: redactProxy(proxy.Template),
+		}
+		if proxy.quarantinedUntil.After(now) {
+			until := proxy.quarantinedUntil
+			s.QuarantinedUntil = &until
+		}
+		return s
+	}
+
+	proxies := make([]ProxyStatus, 0, len(p.entries))
+	seen := make(map[*ProxyEntry]bool, len(p.entries))
+	for _, proxy := range p.queue {
+		proxies = append(proxies, status(proxy, true))
+		seen[proxy] = true
+	}
+	for _, proxy := range p.entries {
+		if !seen[proxy] {
+			proxies = append(proxies, status(proxy, false))
+		}
+	}
+	if p.fallback != nil {
+		proxies = append(proxies, status(p.fallback, false))
+	}
+	return proxies
+}
+
+// Client returns the HTTP client for the given proxy, creating it on first use.
+// Clients are cached so that connections are kept alive between parts.
+func (p *ProxyPool) Client(proxy *ProxyEntry) (*http.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := proxy.String()
+	if client, ok := p.clients[name]; ok {
+		return client, nil
+	}
+
+	transport, err := newTransport(proxy)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: transport,
+	}
+	p.clients[name] = client
+	return client, nil
+}
+
+// evictClientLocked closes idle connections of the proxy and removes its client. Caller must hold lock.
+func (p *ProxyPool) evictClientLocked(name string) {
+	client, ok := p.clients[name]
+	if !ok {
+		return
+	}
+	client.CloseIdleConnections()
+	delete(p.clients, name)
+}
+
+// Close closes idle connections of all cached clients.
+func (p *ProxyPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name := range p.clients {
+		p.evictClientLocked(name)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// refreshTimeout limits how long a refresh command or endpoint may take.
+const refreshTimeout = 60 * time.Second
+
+// RefreshFunc returns a fresh download URL for an expired signed link.
+type RefreshFunc func() (string, error)
+
+// NewRefreshFunc creates a RefreshFunc from the -refresh-cmd and -refresh-url flags.
+// It returns nil if neither is set.
+func NewRefreshFunc(command, endpoint string) RefreshFunc {
+	switch {
+	case command != "":
+		return func() (string, error) {
+			return refreshFromCommand(command)
+		}
+	case endpoint != "":
+		return func() (string, error) {
+			return refreshFromEndpoint(endpoint)
+		}
+	}
+	return nil
+}
+
+// shellCommand creates a command that runs in the system shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// refreshFromCommand runs command and returns the first line it prints.
+func refreshFromCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, command)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("refresh command failed: %w", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			return validateRefreshedURL(line)
+		}
+	}
+	return "", errors.New("refresh command did not print a URL")
+}
+
+// refreshFromEndpoint requests endpoint and returns the URL from the response body.
+// The body can be the plain URL or a JSON object with a "url" field.
+func refreshFromEndpoint(endpoint string) (string, error) {
+	client := &http.Client{
+		Timeout: refreshTimeout,
+		Transport: &http.Transport{
+			DialContext:     dialThroughUpstream(&net.Dialer{Timeout: time.Duration(connectTimeout) * time.Second}),
+			TLSClientConfig: proxyTLSConfig,
+		},
+	}
+
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("refresh request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("refresh endpoint returned unexpected status: %v", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to read refresh response: %w", err)
+	}
+
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("{")) {
+		var payload struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return "", fmt.Errorf("failed to parse refresh response: %w", err)
+		}
+		return validateRefreshedURL(payload.URL)
+	}
+	return validateRefreshedURL(string(body))
+}
+
+func validateRefreshedURL(rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("refresh returned an invalid URL: %q", rawURL)
+	}
+	return rawURL, nil
+}
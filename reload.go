@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// watchInterval is how often local proxy list files are checked for changes.
+const watchInterval = 5 * time.Second
+
+// WatchProxySources reloads the proxy list into the pool on SIGHUP and, if watch
+// is set, whenever a local proxy list file changes. The list read from stdin
+// cannot be read again, so its entries are taken from initial and kept.
+func WatchProxySources(pool *ProxyPool, sources []string, initial []*ProxyEntry, watch bool) {
+	var stdinEntries []*ProxyEntry
+	for _, entry := range initial {
+		if entry.Source == "stdin" {
+			stdinEntries = append(stdinEntries, entry)
+		}
+	}
+
+	reload := func(reason string) {
+		var reloadable []string
+		for _, source := range sources {
+			if source != "-" {
+				reloadable = append(reloadable, source)
+			}
+		}
+
+		proxies, err := LoadProxySources(reloadable)
+		if err != nil {
+			log.Error("Failed to reload proxy list, keeping the current one.", "err", err)
+			return
+		}
+		proxies = append(proxies, stdinEntries...)
+		if proxyTags != "" {
+			proxies = FilterProxiesByTag(proxies, strings.Split(proxyTags, ","))
+		}
+		if len(proxies) == 0 {
+			log.Error("Reloaded proxy list is empty, keeping the current one.")
+			return
+		}
+
+		added, removed := pool.Update(proxies)
+		log.Info("Reloaded proxy list.", "reason", reason, "added", added, "removed", removed)
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	var ticker <-chan time.Time
+	var lastState string
+	if watch {
+		ticker = time.Tick(watchInterval)
+		lastState = sourcesState(sources)
+	}
+
+	for {
+		select {
+		case <-hangup:
+			reload("SIGHUP")
+		case <-ticker:
+			state := sourcesState(sources)
+			if state == lastState {
+				continue
+			}
+			lastState = state
+			reload("file changed")
+		}
+	}
+}
+
+// sourcesState returns a fingerprint of the size and modification time of all local
+// proxy list files. It changes whenever a file is modified, added or removed.
+func sourcesState(sources []string) string {
+	var state strings.Builder
+	for _, source := range sources {
+		if source == "-" || strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			continue
+		}
+
+		info, err := os.Stat(source)
+		if err != nil {
+			fmt.Fprintf(&state, "%s:missing;", source)
+			continue
+		}
+		if !info.IsDir() {
+			fmt.Fprintf(&state, "%s:%d:%d;", source, info.Size(), info.ModTime().UnixNano())
+			continue
+		}
+
+		dirEntries, err := os.ReadDir(source)
+		if err != nil {
+			continue
+		}
+		for _, dirEntry := range dirEntries {
+			info, err := dirEntry.Info()
+			if err != nil || info.IsDir() {
+				continue
+			}
+			fmt.Fprintf(&state, "%s:%d:%d;", filepath.Join(source, dirEntry.Name()), info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return state.String()
+}
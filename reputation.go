@@ -0,0 +1,314 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// reputationVersion is the format version of the reputation database file.
+const reputationVersion = 1
+
+// reputation stores proxy statistics across runs, nil if disabled.
+var reputation *ReputationDB
+
+// ProxyReputation holds the statistics of one proxy collected over all runs.
+type ProxyReputation struct {
+	Successes           int       `json:"successes"`
+	Failures            int       `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Bytes               int64     `json:"bytes"`
+	Seconds             float64   `json:"seconds"` // time spent downloading successful parts
+	LastFailure         string    `json:"last_failure,omitempty"`
+	LastFailureAt       time.Time `json:"last_failure_at,omitzero"`
+	LastSeen            time.Time `json:"last_seen"`
+}
+
+// SuccessRate returns the share of successful attempts, 0 to 1.
+func (r *ProxyReputation) SuccessRate() float64 {
+	attempts := r.Successes + r.Failures
+	if attempts == 0 {
+		return 0
+	}
+	return float64(r.Successes) / float64(attempts)
+}
+
+// Throughput returns the average download speed in bytes per second.
+func (r *ProxyReputation) Throughput() float64 {
+	if r.Seconds == 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Seconds
+}
+
+// ReputationDB is a JSON file with the reputation of every proxy seen so far.
+// All methods can be called on a nil database and do nothing.
+type ReputationDB struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex // held while the file is written, jobs of the daemon save concurrently
+	path    string
+	proxies map[string]*ProxyReputation // reputationKey -> statistics
+}
+
+type reputationFile struct {
+	Version int                         `json:"version"`
+	Proxies map[string]*ProxyReputation `json:"proxies"`
+}
+
+// DefaultReputationPath returns the database path in the user cache directory.
+func DefaultReputationPath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "multi-proxy-downloader", "reputation.json"), nil
+}
+
+// LoadReputation reads the database at path. A missing file gives an empty database.
+func LoadReputation(path string) (*ReputationDB, error) {
+	db := &ReputationDB{path: path, proxies: make(map[string]*ProxyReputation)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file reputationFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid reputation database %s: %w", path, err)
+	}
+	if file.Version != reputationVersion {
+		return nil, fmt.Errorf("unsupported reputation database version %d", file.Version)
+	}
+	if file.Proxies != nil {
+		db.proxies = file.Proxies
+	}
+	return db, nil
+}
+
+// Save writes the database to its file. The file is replaced atomically,
+// so an interrupted write does not lose the previous statistics.
+func (db *ReputationDB) Save() error {
+	if db == nil {
+		return nil
+	}
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+
+	db.mu.Lock()
+	data, err := json.MarshalIndent(reputationFile{Version: reputationVersion, Proxies: db.proxies}, "", "  ")
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(db.path), 0o755); err != nil {
+		return err
+	}
+	// Proxy URLs can contain credentials
+	tmpPath := db.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, db.path)
+}
+
+// reputationKey returns the name the proxy is stored under. All sessions of
+// a gateway template share the reputation of the template.
+func reputationKey(proxy *ProxyEntry) string {
+	if proxy.Template != "" {
+		return proxy.Template
+	}
+	return proxy.String()
+}
+
+// get returns the statistics of the proxy, creating them if needed. Caller must hold lock.
+func (db *ReputationDB) get(proxy *ProxyEntry) *ProxyReputation {
+	key := reputationKey(proxy)
+	rep, ok := db.proxies[key]
+	if !ok {
+		rep = &ProxyReputation{}
+		db.proxies[key] = rep
+	}
+	return rep
+}
+
+// RecordSuccess records a part downloaded through the proxy.
+func (db *ReputationDB) RecordSuccess(proxy *ProxyEntry, bytes int64, elapsed time.Duration) {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rep := db.get(proxy)
+	rep.Successes++
+	rep.ConsecutiveFailures = 0
+	rep.Bytes += bytes
+	rep.Seconds += elapsed.Seconds()
+	rep.LastSeen = time.Now()
+}
+
+// RecordFailure records a failed attempt through the proxy, see FailureReason.
+func (db *ReputationDB) RecordFailure(proxy *ProxyEntry, reason string) {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rep := db.get(proxy)
+	rep.Failures++
+	rep.ConsecutiveFailures++
+	rep.LastFailure = reason
+	rep.LastFailureAt = time.Now()
+	rep.LastSeen = rep.LastFailureAt
+}
+
+// Score returns how much the proxy is preferred based on its past success rate.
+// Unknown proxies get 1, the score approaches 0 for proxies that always fail.
+func (db *ReputationDB) Score(proxy *ProxyEntry) float64 {
+	if db == nil {
+		return 1
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rep, ok := db.proxies[reputationKey(proxy)]
+	if !ok {
+		return 1
+	}
+	// Laplace smoothing, a proxy with a single failure is not written off
+	return 2 * float64(rep.Successes+1) / float64(rep.Successes+rep.Failures+2)
+}
+
+// Seed continues the quarantine of a proxy that was failing at the end of the last run.
+func (db *ReputationDB) Seed(proxy *ProxyEntry) {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rep, ok := db.proxies[reputationKey(proxy)]
+	if !ok || rep.ConsecutiveFailures == 0 {
+		return
+	}
+	proxy.failures = rep.ConsecutiveFailures
+	proxy.quarantinedUntil = rep.LastFailureAt.Add(quarantineBackoff(rep.ConsecutiveFailures))
+}
+
+// Prune removes proxies not seen for olderThan and proxies with at least minAttempts
+// attempts and a success rate below minRate. Returns the number of removed proxies.
+func (db *ReputationDB) Prune(olderThan time.Duration, minRate float64, minAttempts int) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	removed := 0
+	for key, rep := range db.proxies {
+		stale := olderThan > 0 && time.Since(rep.LastSeen) > olderThan
+		bad := rep.Successes+rep.Failures >= minAttempts && rep.SuccessRate() < minRate
+		if stale || bad {
+			delete(db.proxies, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// runReputationCommand implements the "reputation list|prune" subcommand.
+func runReputationCommand(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: multi-proxy-downloader reputation list|prune [flags]")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	defaultPath, _ := DefaultReputationPath()
+	flags := flag.NewFlagSet("reputation "+args[0], flag.ExitOnError)
+	path := flags.String("db", defaultPath, "Path to the reputation database")
+
+	switch args[0] {
+	case "list":
+		sortBy := flags.String("sort", "rate", "Sort by rate, throughput or seen")
+		flags.Parse(args[1:])
+
+		db, err := LoadReputation(*path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printReputation(db, *sortBy)
+		return 0
+
+	case "prune":
+		olderThan := flags.Duration("older-than", 30*24*time.Hour, "Remove proxies not seen for this long (0 to keep all)")
+		minRate := flags.Float64("min-rate", 0, "Remove proxies with a success rate below this value (0-1)")
+		minAttempts := flags.Int("min-attempts", 5, "Only remove proxies by rate after this many attempts")
+		flags.Parse(args[1:])
+
+		db, err := LoadReputation(*path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		removed := db.Prune(*olderThan, *minRate, *minAttempts)
+		if err := db.Save(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Removed %d proxies, %d left.\n", removed, len(db.proxies))
+		return 0
+
+	default:
+		usage()
+		return 2
+	}
+}
+
+// printReputation prints the database as a table. Proxy passwords are hidden.
+func printReputation(db *ReputationDB, sortBy string) {
+	keys := make([]string, 0, len(db.proxies))
+	for key := range db.proxies {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		ra, rb := db.proxies[a], db.proxies[b]
+		switch sortBy {
+		case "throughput":
+			return cmp.Compare(rb.Throughput(), ra.Throughput())
+		case "seen":
+			return rb.LastSeen.Compare(ra.LastSeen)
+		default:
+			return cmp.Compare(rb.SuccessRate(), ra.SuccessRate())
+		}
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROXY\tOK\tFAILED\tRATE\tSPEED\tLAST FAILURE\tLAST SEEN")
+	for _, key := range keys {
+		rep := db.proxies[key]
+		name := redactProxy(key)
+		lastFailure := "-"
+		if rep.LastFailure != "" {
+			lastFailure = fmt.Sprintf("%s (%s)", rep.LastFailure, rep.LastFailureAt.Format(time.DateTime))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.0f%%\t%.2f MB/s\t%s\t%s\n", name, rep.Successes, rep.Failures,
+			rep.SuccessRate()*100, rep.Throughput()/(1024*1024), lastFailure, rep.LastSeen.Format(time.DateTime))
+	}
+	w.Flush()
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Job states. A job that was running when the daemon stopped is queued again on start
+// and continues from the parts already downloaded.
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// queueVersion is increased on incompatible changes of the queue file.
+const queueVersion = 1
+
+// Job is a download in the daemon queue.
+type Job struct {
+	ID         string     `json:"id"`
+	URL        string     `json:"url"`
+	Dir        string     `json:"dir,omitempty"`    // relative to the download directory
+	Output     string     `json:"output,omitempty"` // relative to the job directory
+	Priority   int        `json:"priority"`         // jobs with a higher priority start first
+	MaxWorkers int        `json:"max_workers,omitempty"`
+	PartSize   int64      `json:"part_size,omitempty"` // bytes
+	Overwrite  bool       `json:"overwrite,omitempty"`
+	Paused     bool       `json:"paused,omitempty"` // a paused job is not started, a running one finishes its current parts
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	Path       string     `json:"path,omitempty"` // absolute output path, known once the download started
+	Size       int64      `json:"size,omitempty"`
+	Created    time.Time  `json:"created"`
+	Started    *time.Time `json:"started,omitempty"`
+	Finished   *time.Time `json:"finished,omitempty"`
+
+	download *Download
+}
+
+// JobView is a job with the progress of its download while it is running.
+type JobView struct {
+	Job
+	Progress *DownloadStatus `json:"progress,omitempty"`
+}
+
+type queueFile struct {
+	Version int    `json:"version"`
+	Jobs    []*Job `json:"jobs"`
+}
+
+// JobQueue runs download jobs through a shared proxy pool, a limited number at a time.
+// The queue is saved to disk on every change.
+type JobQueue struct {
+	mu      sync.Mutex
+	path    string
+	jobs    []*Job // in the order they were added
+	pool    *ProxyPool
+	dir     string
+	maxJobs int
+	running int
+}
+
+// DefaultQueuePath returns the location of the job queue in the user cache directory.
+func DefaultQueuePath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "multi-proxy-downloader", "queue.json"), nil
+}
+
+// LoadJobQueue loads the queue from path. A missing file is an empty queue.
+// Jobs are not started until Start is called.
+func LoadJobQueue(path string, pool *ProxyPool, dir string, maxJobs int) (*JobQueue, error) {
+	q := &JobQueue{path: path, pool: pool, dir: dir, maxJobs: max(maxJobs, 1)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file queueFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid job queue %s: %w", path, err)
+	}
+	if file.Version != queueVersion {
+		return nil, fmt.Errorf("unsupported job queue version %d", file.Version)
+	}
+	for _, job := range file.Jobs {
+		if job.State == JobRunning {
+			job.State = JobQueued
+		}
+	}
+	q.jobs = file.Jobs
+	return q, nil
+}
+
+// Start starts the queued jobs.
+func (q *JobQueue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.scheduleLocked()
+}
+
+// Add queues a new job.
+func (q *JobQueue) Add(job Job) (JobView, error) {
+	parsed, err := url.Parse(job.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return JobView{}, fmt.Errorf("invalid URL %q", job.URL)
+	}
+	if job.MaxWorkers < 0 || job.PartSize < 0 {
+		return JobView{}, errors.New("max_workers and part_size must not be negative")
+	}
+	if err := checkJobPaths(job); err != nil {
+		return JobView{}, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job.ID = newJobID()
+	job.State = JobQueued
+	job.Paused = false
+	job.Created = time.Now()
+	job.Error, job.Path, job.Size, job.Started, job.Finished = "", "", 0, nil, nil
+	added := &job
+	q.jobs = append(q.jobs, added)
+	log.Info("Job queued.", "id", job.ID, "url", job.URL, "priority", job.Priority)
+
+	q.saveLocked()
+	q.scheduleLocked()
+	return q.viewLocked(added), nil
+}
+
+// checkJobPaths checks that the directory and output file of a job stay inside the download directory.
+func checkJobPaths(job Job) error {
+	if job.Dir != "" && !filepath.IsLocal(job.Dir) {
+		return fmt.Errorf("dir %q must be a relative path inside the download directory", job.Dir)
+	}
+	if job.Output != "" && !filepath.IsLocal(job.Output) {
+		return fmt.Errorf("output %q must be a relative path inside the job directory", job.Output)
+	}
+	return nil
+}
+
+// List returns all jobs, including finished ones.
+func (q *JobQueue) List() []JobView {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	views := make([]JobView, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		views = append(views, q.viewLocked(job))
+	}
+	return views
+}
+
+// Get returns the job with the given id.
+func (q *JobQueue) Get(id string) (JobView, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.findLocked(id)
+	if job == nil {
+		return JobView{}, fmt.Errorf("job %s not found", id)
+	}
+	return q.viewLocked(job), nil
+}
+
+// Download returns the download of a running job.
+func (q *JobQueue) Download(id string) (*Download, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.findLocked(id)
+	if job == nil {
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	if job.download == nil {
+		return nil, fmt.Errorf("job %s is not running", id)
+	}
+	return job.download, nil
+}
+
+// SetPriority changes the priority of a job, which matters while it is queued.
+func (q *JobQueue) SetPriority(id string, priority int) (JobView, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.findLocked(id)
+	if job == nil {
+		return JobView{}, fmt.Errorf("job %s not found", id)
+	}
+	job.Priority = priority
+	q.saveLocked()
+	return q.viewLocked(job), nil
+}
+
+// Cancel stops a running job or takes a queued job out of the queue.
+func (q *JobQueue) Cancel(id string) (JobView, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.findLocked(id)
+	if job == nil {
+		return JobView{}, fmt.Errorf("job %s not found", id)
+	}
+	switch job.State {
+	case JobQueued:
+		now := time.Now()
+		job.State = JobCanceled
+		job.Finished = &now
+		q.saveLocked()
+	case JobRunning:
+		// The job is marked as canceled when its download returns
+		job.download.Cancel()
+	default:
+		return JobView{}, fmt.Errorf("job %s is already %s", id, job.State)
+	}
+	return q.viewLocked(job), nil
+}
+
+// Pause pauses a job. A queued job is not started until it is resumed.
+func (q *JobQueue) Pause(id string) (JobView, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.findLocked(id)
+	if job == nil {
+		return JobView{}, fmt.Errorf("job %s not found", id)
+	}
+	switch job.State {
+	case JobQueued:
+	case JobRunning:
+		if err := job.download.Pause(); err != nil {
+			return JobView{}, err
+		}
+	default:
+		return JobView{}, fmt.Errorf("job %s is already %s", id, job.State)
+	}
+	job.Paused = true
+	q.saveLocked()
+	return q.viewLocked(job), nil
+}
+
+// Unpause resumes a paused job.
+func (q *JobQueue) Unpause(id string) (JobView, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.findLocked(id)
+	if job == nil {
+		return JobView{}, fmt.Errorf("job %s not found", id)
+	}
+	job.Paused = false
+	if job.download != nil {
+		job.download.Resume()
+	}
+	q.saveLocked()
+	q.scheduleLocked()
+	return q.viewLocked(job), nil
+}
+
+// Remove deletes a job that is not running from the queue and its history.
+func (q *JobQueue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.findLocked(id)
+	if job == nil {
+		return fmt.Errorf("job %s not found", id)
+	}
+	if job.State == JobRunning {
+		return fmt.Errorf("job %s is running, cancel it first", id)
+	}
+	q.jobs = slices.DeleteFunc(q.jobs, func(queued *Job) bool {
+		return queued == job
+	})
+	q.saveLocked()
+	return nil
+}
+
+// Counts returns the number of running and queued jobs.
+func (q *JobQueue) Counts() (running, queued int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, job := range q.jobs {
+		if job.State == JobQueued {
+			queued++
+		}
+	}
+	return q.running, queued
+}
+
+// Save writes the queue to disk.
+func (q *JobQueue) Save() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.saveLocked()
+}
+
+// findLocked returns the job with the given id or nil. Caller must hold lock.
+func (q *JobQueue) findLocked(id string) *Job {
+	index := slices.IndexFunc(q.jobs, func(job *Job) bool {
+		return job.ID == id
+	})
+	if index == -1 {
+		return nil
+	}
+	return q.jobs[index]
+}
+
+// viewLocked returns a copy of the job with its progress. Caller must hold lock.
+func (q *JobQueue) viewLocked(job *Job) JobView {
+	view := JobView{Job: *job}
+	if job.download != nil {
+		status := job.download.Status()
+		view.Progress = &status
+	}
+	return view
+}
+
+// scheduleLocked starts queued jobs with the highest priority, the oldest first,
+// while fewer than maxJobs are running. Caller must hold lock.
+func (q *JobQueue) scheduleLocked() {
+	for q.running < q.maxJobs {
+		var next *Job
+		for _, job := range q.jobs {
+			if job.State == JobQueued && !job.Paused && (next == nil || job.Priority > next.Priority) {
+				next = job
+			}
+		}
+		if next == nil {
+			return
+		}
+
+		partSize := next.PartSize
+		if partSize == 0 {
+			partSize = partSizeBytes
+		}
+		maxWorkers := next.MaxWorkers
+		if maxWorkers == 0 {
+			maxWorkers = maxConcurrentDownloads
+		}
+		now := time.Now()
+		// Queue files of older versions may contain paths outside the download directory
+		if err := checkJobPaths(*next); err != nil {
+			next.State = JobFailed
+			next.Error = err.Error()
+			next.Finished = &now
+			log.Error("Job failed.", "id", next.ID, "err", err)
+			q.saveLocked()
+			continue
+		}
+		next.State = JobRunning
+		next.Error = ""
+		next.Started = &now
+		next.Finished = nil
+		next.download = NewDownload(q.pool, DownloadOptions{
+			URL:          next.URL,
+			Output:       next.Output,
+			Overwrite:    next.Overwrite,
+			PartSize:     partSize,
+			MaxWorkers:   maxWorkers,
+			Dir:          filepath.Join(q.dir, next.Dir),
+			WorkerPrefix: next.ID + "/",
+			Quiet:        true,
+			Shared:       true,
+		})
+		q.running++
+		q.saveLocked()
+		go q.run(next)
+	}
+}
+
+// run downloads a job and starts the next one when it is done.
+func (q *JobQueue) run(job *Job) {
+	log.Info("Job started.", "id", job.ID, "url", job.URL)
+	err := job.download.Run()
+	saveReputation()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	status := job.download.Status()
+	job.Path = status.Output
+	job.Size = status.Size
+	job.Finished = &now
+	job.download = nil
+	switch {
+	case err == nil:
+		job.State = JobDone
+		log.Info("Job finished.", "id", job.ID, "path", job.Path)
+	case errors.Is(err, context.Canceled):
+		job.State = JobCanceled
+		log.Info("Job canceled.", "id", job.ID)
+	default:
+		job.State = JobFailed
+		job.Error = err.Error()
+		log.Error("Job failed.", "id", job.ID, "err", err)
+	}
+
+	q.running--
+	q.saveLocked()
+	q.scheduleLocked()
+
+	// Canceled jobs were stopped on purpose and do not run the hooks
+	if job.State != JobCanceled {
+		duration := now.Sub(*job.Started)
+		go hooks.Finished(job.URL, job.Path, duration, err)
+	}
+}
+
+// saveLocked writes the queue to disk, errors are logged. Caller must hold lock.
+func (q *JobQueue) saveLocked() {
+	data, err := json.MarshalIndent(queueFile{Version: queueVersion, Jobs: q.jobs}, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(q.path), 0o755)
+	}
+	if err == nil {
+		// Download URLs can contain credentials
+		tmpPath := q.path + ".tmp"
+		err = os.WriteFile(tmpPath, data, 0o600)
+		if err == nil {
+			err = os.Rename(tmpPath, q.path)
+		}
+	}
+	if err != nil {
+		log.Error("Failed to save job queue.", "err", err)
+	}
+}
+
+// newJobID returns a random 16 character hex job id.
+func newJobID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Serve runs the download daemon until it is stopped by SIGINT or SIGTERM.
+func Serve(pool *ProxyPool) {
+	if queuePath == "" {
+		var err error
+		queuePath, err = DefaultQueuePath()
+		if err != nil {
+			log.Fatal("Error locating job queue!", "err", err)
+		}
+	}
+	queue, err := LoadJobQueue(queuePath, pool, downloadDir, concurrentJobs)
+	if err != nil {
+		log.Fatal("Error reading job queue!", "err", err)
+	}
+	log.Debug("", "Job queue", queuePath)
+
+	listener, err := listen(listenAddr)
+	if err != nil {
+		log.Fatal("Error starting API!", "err", err)
+	}
+	defer listener.Close()
+
+	// All routes except the aria2 interface, which checks its token itself, need the secret
+	api := http.NewServeMux()
+	handleJobs(api, queue)
+	handleProxies(api, pool)
+	handleDashboard(api, queue, pool)
+	mux := http.NewServeMux()
+	for _, pattern := range []string{"/{$}", "/dashboard/", "/jobs", "/jobs/", "/proxies"} {
+		mux.Handle(pattern, requireSecret(rpcSecret, api))
+	}
+	handleAria2(mux, queue, rpcSecret, rpcAllowOriginAll)
+	go http.Serve(listener, mux)
+
+	metrics.RegisterGauge("mpd_jobs_running", "Jobs currently downloading.", func() float64 {
+		running, _ := queue.Counts()
+		return float64(running)
+	})
+	metrics.RegisterGauge("mpd_jobs_queued", "Jobs waiting in the queue.", func() float64 {
+		_, queued := queue.Counts()
+		return float64(queued)
+	})
+
+	queue.Start()
+	log.Info("Waiting for download jobs.", "address", listenAddr, "jobs", concurrentJobs, "directory", downloadDir)
+
+	// Running jobs stay in the queue file and continue on the next start
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Info("Stopping.")
+	queue.Save()
+	saveReputation()
+}
+
+// handleJobs registers the routes of the job API.
+func handleJobs(mux *http.ServeMux, queue *JobQueue) {
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, queue.List())
+	})
+	mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		var job Job
+		if err := decodeJSON(w, r, &job); err != nil {
+			return
+		}
+		view, err := queue.Add(job)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, view)
+	})
+	mux.HandleFunc("GET /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		view, err := queue.Get(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, view)
+	})
+	mux.HandleFunc("DELETE /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := queue.Remove(r.PathValue("id")); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /jobs/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		view, err := queue.Cancel(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, view)
+	})
+	mux.HandleFunc("POST /jobs/{id}/pause", func(w http.ResponseWriter, r *http.Request) {
+		view, err := queue.Pause(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, view)
+	})
+	mux.HandleFunc("POST /jobs/{id}/resume", func(w http.ResponseWriter, r *http.Request) {
+		view, err := queue.Unpause(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, view)
+	})
+	mux.HandleFunc("POST /jobs/{id}/priority", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Priority int `json:"priority"`
+		}
+		if err := decodeJSON(w, r, &body); err != nil {
+			return
+		}
+		view, err := queue.SetPriority(r.PathValue("id"), body.Priority)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, view)
+	})
+
+	// Status, parts and workers of running jobs, the same as the control API
+	handleDownload(mux, "/jobs/{id}", func(r *http.Request) (*Download, error) {
+		return queue.Download(r.PathValue("id"))
+	})
+}
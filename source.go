@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// minResolveInterval limits how often the redirect chain is followed again,
+// so that many failing workers do not hammer the rate-limited front door.
+const minResolveInterval = 10 * time.Second
+
+// Source holds the URL given by the user and the final URL it redirects to.
+// Workers download from the final URL directly, so the redirect chain is
+// only followed once, and again when the final URL stops working.
+type Source struct {
+	mu            sync.Mutex
+	url           string
+	finalURL      string
+	expires       time.Time
+	lastResolved  time.Time
+	contentLength int64
+	etag          string
+	refresh       RefreshFunc   // optional, provides a new URL for expired links
+	resolving     chan struct{} // closed when the running resolve finishes, nil if none is running
+}
+
+// NewSource creates a source for fileURL described by the probe result info.
+// If refresh is not nil, it is used to get a new URL when the link expires.
+func NewSource(fileURL string, info FileInfo, refresh RefreshFunc) *Source {
+	s := &Source{
+		url:           fileURL,
+		contentLength: info.ContentLength,
+		etag:          info.ETag,
+		refresh:       refresh,
+	}
+	s.setFinalURL(info.FinalURL)
+	return s
+}
+
+// setFinalURL records the final URL and its expiry. Caller must hold lock or own s.
+func (s *Source) setFinalURL(finalURL string) {
+	s.finalURL = finalURL
+	s.expires = time.Time{}
+	if parsed, err := url.Parse(finalURL); err == nil {
+		s.expires, _ = URLExpiry(parsed)
+	}
+
+	if finalURL != s.url {
+		log.Info("Resolved redirect.", "final url", finalURL)
+	}
+	if !s.expires.IsZero() {
+		log.Info("Download link expires.", "at", s.expires.Format(time.DateTime), "in", time.Until(s.expires).Round(time.Second))
+	}
+}
+
+// FinalURL returns the URL workers should download from.
+func (s *Source) FinalURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.finalURL
+}
+
+// Expires returns the expiry time of the final URL, or zero if unknown.
+func (s *Source) Expires() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expires
+}
+
+// Resolve follows the redirect chain of the original URL again after failedURL
+// stopped working. If a refresh hook is configured, it is asked for a new URL first.
+// The new URL must point to the same file, which is checked by its size and ETag.
+// If another worker has already replaced failedURL, or the last resolve was too
+// recent, the current final URL is returned unchanged. Workers calling it while
+// another one is resolving wait for its result.
+func (s *Source) Resolve(failedURL string) (string, error) {
+	s.mu.Lock()
+	if done := s.resolving; done != nil {
+		s.mu.Unlock()
+		<-done
+		return s.FinalURL(), nil
+	}
+	if s.finalURL != failedURL || time.Since(s.lastResolved) < minResolveInterval {
+		defer s.mu.Unlock()
+		return s.finalURL, nil
+	}
+	s.lastResolved = time.Now()
+	fileURL := s.url
+	done := make(chan struct{})
+	s.resolving = done
+	s.mu.Unlock()
+
+	// The hook and the requests run without the lock, so the other workers can keep downloading
+	fileURL, info, err := s.resolve(fileURL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resolving = nil
+	close(done)
+	if err != nil {
+		return s.finalURL, err
+	}
+	if fileURL != s.url {
+		log.Info("Download link refreshed.", "url", fileURL)
+		s.url = fileURL
+	}
+	s.setFinalURL(info.FinalURL)
+	return s.finalURL, nil
+}
+
+// resolve asks the refresh hook for a new URL, if there is one, and gets the file info
+// of it or of fileURL, checking that it is still the same file. The hook, size and ETag
+// never change, so it does not need the lock.
+func (s *Source) resolve(fileURL string) (string, FileInfo, error) {
+	if s.refresh != nil {
+		log.Warn("Download link rejected, requesting a fresh link.")
+		freshURL, err := s.refresh()
+		if err != nil {
+			return "", FileInfo{}, err
+		}
+		fileURL = freshURL
+	} else {
+		log.Warn("Download link rejected, resolving redirects again.", "url", fileURL)
+	}
+
+	info, err := GetFileInfo(fileURL, "")
+	if err != nil {
+		return "", FileInfo{}, err
+	}
+	if s.contentLength > 0 && info.ContentLength != s.contentLength {
+		return "", FileInfo{}, fmt.Errorf("new link points to a different file. Expected size: %d, current size: %d", s.contentLength, info.ContentLength)
+	}
+	if !SameETag(s.etag, info.ETag) {
+		return "", FileInfo{}, fmt.Errorf("new link points to a different file. Expected ETag: %s, current ETag: %s", s.etag, info.ETag)
+	}
+	return fileURL, info, nil
+}
+
+// IsLinkExpired reports whether err means that the download link is no longer valid.
+func IsLinkExpired(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.StatusCode == http.StatusForbidden || statusErr.StatusCode == http.StatusGone
+}
+
+// URLExpiry derives the expiry time of a signed URL from its query parameters.
+// Supported are AWS S3 (v2 and v4), Google Cloud Storage, CloudFront and Azure SAS style links.
+func URLExpiry(u *url.URL) (time.Time, bool) {
+	query := make(url.Values)
+	for key, values := range u.Query() {
+		query[strings.ToLower(key)] = values
+	}
+
+	// Signature V4: X-Amz-Date=20240101T000000Z&X-Amz-Expires=3600
+	for _, prefix := range []string{"x-amz-", "x-goog-"} {
+		date, expires := query.Get(prefix+"date"), query.Get(prefix+"expires")
+		if date == "" || expires == "" {
+			continue
+		}
+		signedAt, err := time.Parse("20060102T150405Z", date)
+		if err != nil {
+			continue
+		}
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			continue
+		}
+		return signedAt.Add(time.Duration(seconds) * time.Second), true
+	}
+
+	// Unix timestamps: Expires=1700000000 (S3 v2, CloudFront), exp, e
+	for _, key := range []string{"expires", "exp", "e"} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || timestamp < 1e9 {
+			continue
+		}
+		return time.Unix(timestamp, 0), true
+	}
+
+	// Azure SAS: se=2024-01-01T00:00:00Z
+	if value := query.Get("se"); value != "" {
+		if expires, err := time.Parse(time.RFC3339, value); err == nil {
+			return expires, true
+		}
+	}
+
+	return time.Time{}, false
+}
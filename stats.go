@@ -0,0 +1,255 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// RunStats collects per-proxy and per-worker statistics of the current run.
+type RunStats struct {
+	mu      sync.Mutex
+	start   time.Time
+	end     time.Time
+	proxies map[string]*proxyRunStats  // proxy name -> stats
+	workers map[string]*workerRunStats // workerID -> stats
+}
+
+type proxyRunStats struct {
+	bytes     int64
+	parts     int
+	failures  map[string]int // FailureReason -> count
+	transfer  time.Duration  // time spent downloading successful parts
+	ttfbTotal time.Duration
+	ttfbCount int
+}
+
+type workerRunStats struct {
+	bytes    int64
+	parts    int
+	failures int
+	busy     time.Duration
+}
+
+var runStats = &RunStats{
+	start:   time.Now(),
+	proxies: make(map[string]*proxyRunStats),
+	workers: make(map[string]*workerRunStats),
+}
+
+// Start resets the start of the run, used to compute worker utilisation.
+func (s *RunStats) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = time.Now()
+}
+
+// Finish marks the end of the run, after all workers have stopped.
+func (s *RunStats) Finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end = time.Now()
+}
+
+// Duration returns the time from the start to the end of the run, or until now if it is still running.
+func (s *RunStats) Duration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.durationLocked()
+}
+
+func (s *RunStats) durationLocked() time.Duration {
+	if s.end.IsZero() {
+		return time.Since(s.start)
+	}
+	return s.end.Sub(s.start)
+}
+
+// record adds one download attempt to the statistics. A zero ttfb means
+// that no data was received, an empty workerID that only the proxy statistics
+// are updated. Caller must not hold lock.
+func (s *RunStats) record(workerID string, proxy *ProxyEntry, bytes int64, elapsed, ttfb time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Gateway sessions are counted under their template, each failure mints a new session
+	name := reputationKey(proxy)
+	proxyStats, ok := s.proxies[name]
+	if !ok {
+		proxyStats = &proxyRunStats{failures: make(map[string]int)}
+		s.proxies[name] = proxyStats
+	}
+	if ttfb > 0 {
+		proxyStats.ttfbTotal += ttfb
+		proxyStats.ttfbCount++
+	}
+	if err != nil {
+		proxyStats.failures[FailureReason(err)]++
+	} else {
+		proxyStats.bytes += bytes
+		proxyStats.parts++
+		proxyStats.transfer += elapsed
+	}
+
+	if workerID == "" {
+		return
+	}
+	workerStats, ok := s.workers[workerID]
+	if !ok {
+		workerStats = &workerRunStats{}
+		s.workers[workerID] = workerStats
+	}
+	workerStats.busy += elapsed
+	if err != nil {
+		workerStats.failures++
+		return
+	}
+	workerStats.bytes += bytes
+	workerStats.parts++
+}
+
+// recordAttempt records a download attempt of a part (or the whole file in a single
+// stream) in the statistics of this run and in the reputation database.
+func recordAttempt(workerID string, proxy *ProxyEntry, bytes int64, elapsed, ttfb time.Duration, err error) {
+	runStats.record(workerID, proxy, bytes, elapsed, ttfb, err)
+	metrics.observeAttempt(reputationKey(proxy), bytes, elapsed, err)
+	switch {
+	case IsLinkExpired(err):
+		// Rejected by the download server because the link expired, not the fault of the proxy
+	case err != nil:
+		reputation.RecordFailure(proxy, FailureReason(err))
+	default:
+		reputation.RecordSuccess(proxy, bytes, elapsed)
+	}
+}
+
+// ProxyReport is the summary of one proxy in the statistics report.
+type ProxyReport struct {
+	Proxy       string         `json:"proxy"`
+	Bytes       int64          `json:"bytes"`
+	Parts       int            `json:"parts"`
+	Failures    map[string]int `json:"failures"`
+	Throughput  float64        `json:"throughput"` // bytes per second while downloading
+	AverageTTFB float64        `json:"average_ttfb"`
+}
+
+// WorkerReport is the summary of one worker in the statistics report.
+type WorkerReport struct {
+	Worker      string  `json:"worker"`
+	Bytes       int64   `json:"bytes"`
+	Parts       int     `json:"parts"`
+	Failures    int     `json:"failures"`
+	Utilisation float64 `json:"utilisation"` // share of the run spent downloading, 0 to 1
+}
+
+// StatsReport is the statistics report printed at the end of a run.
+type StatsReport struct {
+	Duration float64        `json:"duration"`
+	Proxies  []ProxyReport  `json:"proxies"`
+	Workers  []WorkerReport `json:"workers"`
+	Sources  map[string]int `json:"sources,omitempty"` // proxy list source -> failed proxies, with several sources
+}
+
+// Report returns the statistics collected so far. Proxies are sorted by downloaded bytes.
+func (s *RunStats) Report() StatsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	duration := s.durationLocked()
+	report := StatsReport{Duration: duration.Seconds()}
+
+	for name, stats := range s.proxies {
+		proxyReport := ProxyReport{
+			Proxy:    redactProxy(name),
+			Bytes:    stats.bytes,
+			Parts:    stats.parts,
+			Failures: maps.Clone(stats.failures),
+		}
+		if stats.transfer > 0 {
+			proxyReport.Throughput = float64(stats.bytes) / stats.transfer.Seconds()
+		}
+		if stats.ttfbCount > 0 {
+			proxyReport.AverageTTFB = (stats.ttfbTotal / time.Duration(stats.ttfbCount)).Seconds()
+		}
+		report.Proxies = append(report.Proxies, proxyReport)
+	}
+	slices.SortFunc(report.Proxies, func(a, b ProxyReport) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), strings.Compare(a.Proxy, b.Proxy))
+	})
+
+	for _, workerID := range slices.Sorted(maps.Keys(s.workers)) {
+		stats := s.workers[workerID]
+		report.Workers = append(report.Workers, WorkerReport{
+			Worker:      workerID,
+			Bytes:       stats.bytes,
+			Parts:       stats.parts,
+			Failures:    stats.failures,
+			Utilisation: min(stats.busy.Seconds()/duration.Seconds(), 1),
+		})
+	}
+	slices.SortStableFunc(report.Workers, func(a, b WorkerReport) int {
+		ai, _ := strconv.Atoi(a.Worker)
+		bi, _ := strconv.Atoi(b.Worker)
+		return cmp.Compare(ai, bi)
+	})
+
+	return report
+}
+
+// Print writes the report as tables of the proxies, workers and proxy list sources.
+func (r StatsReport) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROXY\tDOWNLOADED\tPARTS\tFAILURES\tSPEED\tTTFB")
+	for _, proxy := range r.Proxies {
+		fmt.Fprintf(tw, "%s\t%.2f MB\t%d\t%s\t%.2f MB/s\t%s\n", proxy.Proxy, float64(proxy.Bytes)/(1024*1024), proxy.Parts,
+			formatFailures(proxy.Failures), proxy.Throughput/(1024*1024), time.Duration(proxy.AverageTTFB*float64(time.Second)).Round(time.Millisecond))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "WORKER\tDOWNLOADED\tPARTS\tFAILURES\tUTILISATION")
+	for _, worker := range r.Workers {
+		fmt.Fprintf(tw, "%s\t%.2f MB\t%d\t%d\t%.0f%%\n", worker.Worker, float64(worker.Bytes)/(1024*1024), worker.Parts, worker.Failures, worker.Utilisation*100)
+	}
+	if len(r.Sources) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "SOURCE\tFAILED PROXIES")
+		for _, source := range slices.Sorted(maps.Keys(r.Sources)) {
+			fmt.Fprintf(tw, "%s\t%d\n", source, r.Sources[source])
+		}
+	}
+	tw.Flush()
+}
+
+// WriteJSON writes the report as JSON to path, or to stdout if path is "-".
+func (r StatsReport) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// formatFailures formats failure counts by reason, e.g. "dial:2 timeout:1".
+func formatFailures(failures map[string]int) string {
+	if len(failures) == 0 {
+		return "-"
+	}
+	var parts []string
+	for _, reason := range slices.Sorted(maps.Keys(failures)) {
+		parts = append(parts, fmt.Sprintf("%s:%d", reason, failures[reason]))
+	}
+	return strings.Join(parts, " ")
+}
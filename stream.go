@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/log"
+	"github.com/schollz/progressbar/v3"
+)
+
+// downloadSingleStream downloads the whole file through one proxy at a time.
+// It is used when the server does not support range requests. Since the download
+// cannot be resumed, a proxy failure restarts it from scratch with the next proxy.
+// The content length may be -1 if the server does not report the size.
+func (d *Download) downloadSingleStream() error {
+	workerID := d.opts.WorkerPrefix + "0"
+	pool, source, absOutputPath, contentLength := d.pool, d.source, d.outputPath, d.info.ContentLength
+	tmpPath := absOutputPath + ".part"
+	defer os.Remove(tmpPath)
+
+	var bar *progressbar.ProgressBar
+	if !verbose && !d.opts.Quiet {
+		bar = progressbar.NewOptions64(contentLength,
+			progressbar.OptionSetWriter(consoleOut),
+			progressbar.OptionShowCount(),
+			progressbar.OptionEnableColorCodes(true),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionFullWidth(),
+			progressbar.OptionSetDescription("Downloading:"),
+			progressbar.OptionSetTheme(progressbar.Theme{
+				Saucer:        lipgloss.NewStyle().Foreground(lipgloss.Color("86")).Render("━"),
+				SaucerHead:    lipgloss.NewStyle().Foreground(lipgloss.Color("86")).Render("━"),
+				SaucerPadding: " ",
+				BarStart:      "┃",
+				BarEnd:        "┃",
+			}))
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	d.startReporting(done)
+
+	// Periodic progress logging, the part based status is not available here
+	if verbose && !d.opts.Quiet {
+		go func() {
+			ticker := time.NewTicker(5 * time.Second)
+			defer ticker.Stop()
+			var last int64
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					d.mu.Lock()
+					current := d.downloaded
+					d.mu.Unlock()
+					speed := float64(current-last) / 5
+					last = current
+					total := "unknown"
+					if contentLength > 0 {
+						total = fmt.Sprintf("%.2f MB", float64(contentLength)/(1024*1024))
+					}
+					log.Info("Download progress",
+						"downloaded", fmt.Sprintf("%.2f MB", float64(current)/(1024*1024)),
+						"total", total,
+						"speed", fmt.Sprintf("%.2f Mbps", (speed*8)/1000000),
+					)
+				}
+			}
+		}()
+	}
+
+	var retryCounter = 0
+	var proxy *ProxyEntry
+	var lastErr error
+	attempt := 0
+	for {
+		if err := d.ctx.Err(); err != nil {
+			_ = pool.Release(workerID)
+			return err
+		}
+
+		var err error
+		if (retryCounter >= proxyMaxRetry && proxyMaxRetry != 0) || (retryCounter > proxyMaxRetry && proxyMaxRetry == 0) {
+			retryCounter = 0
+			if proxy != nil {
+				events.Emit(EventProxyFailed, ProxyFailedEvent{Worker: workerID, Proxy: redactProxy(proxy.String()), Reason: FailureReason(lastErr)})
+			}
+			proxy, err = pool.Fail(d.ctx, workerID)
+		} else {
+			proxy, err = pool.Assign(d.ctx, workerID)
+		}
+		if err != nil {
+			// Canceled while waiting for a proxy
+			if d.ctx.Err() != nil {
+				return d.ctx.Err()
+			}
+			return fmt.Errorf("error getting proxy URL: %w", err)
+		}
+
+		client, err := pool.Client(proxy)
+		if err != nil {
+			lastErr = err
+			retryCounter = proxyMaxRetry + 1
+			continue
+		}
+
+		fileURL := source.FinalURL()
+		start := time.Now()
+		attempt++
+		d.activeWorkers.Store(1)
+		events.Emit(EventPartStarted, PartStartedEvent{Worker: workerID, Proxy: redactProxy(proxy.String()), End: max(contentLength-1, -1), Attempt: attempt})
+		var firstByte atomic.Int64
+		attemptCtx, state := d.startAttempt(0, proxy, 0, contentLength)
+		downloadedBytes, err := DownloadFile(attemptCtx, client, fileURL, proxy.String(), tmpPath, bar, time.Duration(proxyTimeout)*time.Second, func(n int64) {
+			d.mu.Lock()
+			d.downloaded += n
+			state.downloaded += n
+			d.mu.Unlock()
+			firstByte.CompareAndSwap(0, int64(time.Since(start)))
+			metrics.AddReceived(n)
+		})
+		skipped := d.endAttempt(state)
+		d.activeWorkers.Store(0)
+		if err == nil && contentLength > 0 && downloadedBytes != contentLength {
+			err = fmt.Errorf("%w: got %d bytes, expected %d", ErrSizeMismatch, downloadedBytes, contentLength)
+		}
+		if err != nil && d.ctx.Err() != nil {
+			_ = pool.Release(workerID)
+			return d.ctx.Err()
+		}
+		if err != nil && skipped {
+			err = ErrSkipped
+		}
+		if err != nil {
+			if verbose {
+				log.Warn("Download failed, restarting from scratch.", "proxy", proxy, "err", err)
+			}
+			d.recordError(0, proxy, 0, err)
+			// A skipped proxy is switched without counting a failure
+			if !skipped {
+				recordAttempt(d.statsKey(0), proxy, downloadedBytes, time.Since(start), time.Duration(firstByte.Load()), err)
+			}
+			events.Emit(EventPartFailed, PartFailedEvent{Worker: workerID, Proxy: redactProxy(proxy.String()),
+				Reason: FailureReason(err), Error: err.Error(), Bytes: downloadedBytes, Duration: time.Since(start).Seconds()})
+			lastErr = err
+			_ = os.Remove(tmpPath)
+			if bar != nil {
+				bar.Reset()
+			}
+			d.mu.Lock()
+			d.downloaded = 0
+			d.mu.Unlock()
+
+			if IsLinkExpired(err) {
+				if _, err := source.Resolve(fileURL); err != nil {
+					log.Error("Failed to resolve download link.", "err", err)
+				}
+			}
+
+			if errors.Is(err, ErrSkipped) {
+				retryCounter = 0
+				if _, err := pool.Skip(d.ctx, workerID); err != nil {
+					if d.ctx.Err() != nil {
+						return d.ctx.Err()
+					}
+					return fmt.Errorf("error getting proxy URL: %w", err)
+				}
+				continue
+			}
+			if errors.Is(err, ErrTooSlow) {
+				retryCounter = proxyMaxRetry + 1
+				continue
+			}
+			retryCounter++
+			continue
+		}
+
+		_ = pool.Release(workerID)
+		recordAttempt(d.statsKey(0), proxy, downloadedBytes, time.Since(start), time.Duration(firstByte.Load()), nil)
+		events.Emit(EventPartCompleted, PartCompletedEvent{Worker: workerID, Proxy: redactProxy(proxy.String()),
+			Bytes: downloadedBytes, Duration: time.Since(start).Seconds()})
+		if bar != nil {
+			bar.Finish()
+			fmt.Fprintln(consoleOut, "")
+		}
+		return os.Rename(tmpPath, absOutputPath)
+	}
+}
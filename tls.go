@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// TLSOptions describes how outgoing TLS connections should be verified.
+type TLSOptions struct {
+	Insecure   bool     // skip certificate chain and hostname verification
+	CACertPath string   // PEM bundle with additional trusted CAs
+	CertPath   string   // PEM client certificate for mutual TLS
+	KeyPath    string   // PEM private key for the client certificate
+	Pins       []string // base64 SHA-256 hashes of the server SPKI
+	PinHost    string   // host the pins apply to (the download server)
+}
+
+// NewTLSConfig builds the TLS config for the download server and the one for
+// proxies and other servers, like proxy list URLs. Both verify certificates
+// unless Insecure is set. The client certificate and the pins are only used for
+// the download server. Pins are checked even in insecure mode, but only for
+// connections to PinHost so that servers the download redirects to are not rejected.
+func NewTLSConfig(opts TLSOptions) (origin, proxies *tls.Config, err error) {
+	config := &tls.Config{
+		InsecureSkipVerify: opts.Insecure,
+	}
+
+	if opts.CACertPath != "" {
+		pem, err := os.ReadFile(opts.CACertPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read CA certificate file: %w", err)
+		}
+
+		// Extend the system pool instead of replacing it
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no valid certificates found in %s", opts.CACertPath)
+		}
+		config.RootCAs = pool
+	}
+	proxies = config.Clone()
+
+	if opts.CertPath != "" || opts.KeyPath != "" {
+		if opts.CertPath == "" || opts.KeyPath == "" {
+			return nil, nil, errors.New("both client certificate and key must be provided")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertPath, opts.KeyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	pins := make(map[string]bool, len(opts.Pins))
+	for _, pin := range opts.Pins {
+		pin = strings.TrimSpace(pin)
+		pin = strings.TrimPrefix(pin, "sha256//")
+		if pin == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, nil, fmt.Errorf("invalid SPKI pin %q: expected base64 encoded SHA-256 hash", pin)
+		}
+		pins[pin] = true
+	}
+
+	if len(pins) > 0 {
+		pinHost := strings.ToLower(opts.PinHost)
+		// No SNI is sent to IP literals, so the server name is empty for them
+		pinIP := net.ParseIP(pinHost) != nil
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			serverName := strings.ToLower(cs.ServerName)
+			if pinHost != "" && serverName != pinHost && !(pinIP && serverName == "") {
+				return nil
+			}
+			for _, cert := range cs.PeerCertificates {
+				if pins[SPKIHash(cert)] {
+					return nil
+				}
+			}
+			return fmt.Errorf("certificate pin mismatch for %s", opts.PinHost)
+		}
+	}
+
+	return config, proxies, nil
+}
+
+// SPKIHash returns the base64 encoded SHA-256 hash of the certificate public key,
+// in the same format as used by curl --pinnedpubkey and HPKP.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hostnameOf returns the host part of rawURL without the port.
+func hostnameOf(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hostname()
+}
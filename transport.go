@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxIdleConnsPerProxy = 4                // idle keep-alive connections kept per proxy
+	idleConnTimeout      = 90 * time.Second // how long an idle connection is kept open
+)
+
+// ConnStats collects connection reuse statistics of all pooled transports.
+type ConnStats struct {
+	newConns    atomic.Int64
+	reusedConns atomic.Int64
+	setupNanos  atomic.Int64 // total time spent on TCP connect, proxy CONNECT and TLS handshake
+}
+
+var connStats ConnStats
+
+// NewConns returns the number of newly established connections.
+func (s *ConnStats) NewConns() int64 {
+	return s.newConns.Load()
+}
+
+// ReusedConns returns the number of requests served over a kept-alive connection.
+func (s *ConnStats) ReusedConns() int64 {
+	return s.reusedConns.Load()
+}
+
+// AverageSetup returns the average time needed to establish a new connection.
+func (s *ConnStats) AverageSetup() time.Duration {
+	n := s.newConns.Load()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(s.setupNanos.Load() / n)
+}
+
+// TimeSaved estimates the handshake time saved by reusing connections.
+func (s *ConnStats) TimeSaved() time.Duration {
+	return s.AverageSetup() * time.Duration(s.reusedConns.Load())
+}
+
+// withConnTrace attaches a trace to ctx that records connection setup time and reuse.
+func withConnTrace(ctx context.Context) context.Context {
+	var getConnStart time.Time
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			getConnStart = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				connStats.reusedConns.Add(1)
+				return
+			}
+			connStats.newConns.Add(1)
+			if !getConnStart.IsZero() {
+				connStats.setupNanos.Add(int64(time.Since(getConnStart)))
+			}
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace)
+}
+
+// newTransport creates an HTTP transport that connects through the proxy of the entry.
+// Local entries connect directly, bound to their local IP, or through the proxy
+// selected for each request by their ProxyFunc.
+func newTransport(entry *ProxyEntry) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(connectTimeout) * time.Second, // TCP connection timeout
+		KeepAlive: 30 * time.Second,
+	}
+	if entry.LocalAddr != "" {
+		ip := net.ParseIP(entry.LocalAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local address: %q", entry.LocalAddr)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	transport := &http.Transport{
+		DialContext:           dialThroughUpstream(dialer),
+		TLSHandshakeTimeout:   time.Duration(tlsTimeout) * time.Second,    // timeout for TLS handshake
+		ResponseHeaderTimeout: time.Duration(headerTimeout) * time.Second, // timeout for the first headers
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          maxIdleConnsPerProxy,
+		MaxIdleConnsPerHost:   maxIdleConnsPerProxy,
+		IdleConnTimeout:       idleConnTimeout,
+	}
+
+	switch {
+	case entry.ProxyFunc != nil:
+		transport.Proxy = entry.ProxyFunc
+	case entry.URL != "":
+		proxy, err := url.Parse(entry.URL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	splitProxyTLS(transport)
+	return transport, nil
+}
+
+// splitProxyTLS makes the transport connect to HTTPS proxies with proxyTLSConfig, so the
+// pins and the client certificate of TLSClientConfig are only used for the download server.
+// It must be called after the Proxy of the transport is set.
+func splitProxyTLS(transport *http.Transport) {
+	var proxies sync.Map // addresses of the HTTPS proxies returned by Proxy
+	if proxyFunc := transport.Proxy; proxyFunc != nil {
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			proxy, err := proxyFunc(req)
+			if proxy != nil && proxy.Scheme == "https" {
+				port := proxy.Port()
+				if port == "" {
+					port = "443"
+				}
+				proxies.Store(net.JoinHostPort(proxy.Hostname(), port), true)
+			}
+			return proxy, err
+		}
+	}
+
+	// Only the first TLS connection goes through the dialer: to an HTTPS proxy, or to the
+	// download server without a proxy. Behind a proxy the server always gets TLSClientConfig.
+	dial := transport.DialContext
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		config := transport.TLSClientConfig
+		if _, ok := proxies.Load(addr); ok {
+			config = proxyTLSConfig
+		}
+		if config == nil {
+			config = &tls.Config{}
+		}
+		config = config.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if transport.TLSHandshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, transport.TLSHandshakeTimeout)
+			defer cancel()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
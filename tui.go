@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/log"
+)
+
+// tuiInterval is how often the TUI is refreshed.
+const tuiInterval = 250 * time.Millisecond
+
+// tuiMaxMapRows limits the height of the part map, larger files show several parts per cell.
+const tuiMaxMapRows = 6
+
+var (
+	tuiTitleStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("86")).Bold(true)
+	tuiMutedStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
+	tuiDoneStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("86"))
+	tuiActiveStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("221"))
+	tuiPendingStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("238"))
+	tuiErrorStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("204"))
+	tuiSelectStyle  = lipgloss.NewStyle().Background(lipgloss.Color("236"))
+)
+
+type tuiTickMsg time.Time
+
+type tuiDoneMsg struct{}
+
+// tuiModel is the full-screen view of a running download.
+type tuiModel struct {
+	download *Download
+	pool     *ProxyPool
+
+	status   DownloadStatus
+	parts    []FilePart
+	workers  []WorkerStatus
+	errors   []DownloadError
+	selected int // worker id
+	width    int
+	message  string // result of the last key
+}
+
+// RunTUI runs the download with a full-screen view instead of the progress bar.
+// Quitting the view cancels the download, the downloaded parts are kept for resuming.
+func RunTUI(download *Download, pool *ProxyPool) error {
+	// Logs would break the view, they are printed when it is closed
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		os.Stderr.Write(logs.Bytes())
+	}()
+
+	program := tea.NewProgram(&tuiModel{download: download, pool: pool, width: 80}, tea.WithAltScreen(), tea.WithOutput(consoleOut))
+	result := make(chan error, 1)
+	go func() {
+		result <- download.Run()
+		program.Send(tuiDoneMsg{})
+	}()
+
+	_, err := program.Run()
+	download.Cancel()
+	if downloadErr := <-result; downloadErr != nil || err == nil {
+		return downloadErr
+	}
+	return err
+}
+
+func tuiTick() tea.Cmd {
+	return tea.Tick(tuiInterval, func(t time.Time) tea.Msg {
+		return tuiTickMsg(t)
+	})
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	m.refresh()
+	return tuiTick()
+}
+
+// refresh takes a new snapshot of the download.
+func (m *tuiModel) refresh() {
+	m.status = m.download.Status()
+	m.parts = m.download.Parts()
+	m.workers = m.download.Workers()
+	m.errors = m.download.RecentErrors()
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+	case tuiTickMsg:
+		m.refresh()
+		return m, tuiTick()
+	case tuiDoneMsg:
+		return m, tea.Quit
+	case tea.KeyMsg:
+		m.message = ""
+		switch msg.String() {
+		case "q", "ctrl+c":
+			return m, tea.Quit
+		case "p", " ":
+			if m.status.Paused {
+				m.download.Resume()
+				m.message = "Resumed."
+			} else if err := m.download.Pause(); err != nil {
+				m.message = err.Error()
+			} else {
+				m.message = "Paused, workers finish their current part."
+			}
+		case "+", "=":
+			m.setMaxWorkers(m.status.MaxWorkers + 1)
+		case "-":
+			m.setMaxWorkers(m.status.MaxWorkers - 1)
+		case "up", "k":
+			m.moveSelection(-1)
+		case "down", "j":
+			m.moveSelection(1)
+		case "s":
+			if err := m.download.SkipProxy(m.selected); err != nil {
+				m.message = err.Error()
+			} else {
+				m.message = fmt.Sprintf("Skipping the proxy of worker %d.", m.selected)
+			}
+		}
+		m.refresh()
+	}
+	return m, nil
+}
+
+func (m *tuiModel) setMaxWorkers(n int) {
+	if err := m.download.SetMaxWorkers(n); err != nil {
+		m.message = err.Error()
+		return
+	}
+	m.message = fmt.Sprintf("Workers: %d.", n)
+}
+
+// moveSelection selects the previous or next running worker.
+func (m *tuiModel) moveSelection(delta int) {
+	if len(m.workers) == 0 {
+		return
+	}
+	index := 0
+	for i, worker := range m.workers {
+		if worker.Worker == m.selected {
+			index = i
+		}
+	}
+	index = min(max(index+delta, 0), len(m.workers)-1)
+	m.selected = m.workers[index].Worker
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+	status := m.status
+
+	// Header with the overall progress
+	state := status.State
+	if status.Paused {
+		state = "paused"
+	}
+	fmt.Fprintf(&b, "%s  %s  %s\n\n", tuiTitleStyle.Render("multi-proxy-downloader"), status.Output, tuiMutedStyle.Render(state))
+	percentage := 0.0
+	if status.Size > 0 {
+		percentage = float64(status.Downloaded) / float64(status.Size)
+	}
+	eta := "-"
+	if status.Speed > 0 && status.Size > 0 {
+		eta = time.Duration(float64(status.Size-status.Downloaded) / status.Speed * float64(time.Second)).Round(time.Second).String()
+	}
+	barWidth := max(m.width-50, 10)
+	filled := int(percentage * float64(barWidth))
+	fmt.Fprintf(&b, "%s%s %5.1f%%  %.2f MB / %.2f MB  %.2f MB/s  ETA %s\n",
+		tuiDoneStyle.Render(strings.Repeat("━", filled)), tuiPendingStyle.Render(strings.Repeat("━", barWidth-filled)),
+		percentage*100, float64(status.Downloaded)/(1024*1024), float64(max(status.Size, 0))/(1024*1024), status.Speed/(1024*1024), eta)
+	fmt.Fprintf(&b, "%s\n\n", tuiMutedStyle.Render(fmt.Sprintf("parts %d/%d · workers %d/%d · proxy errors %d",
+		status.PartsDone, status.PartsTotal, status.ActiveWorkers, status.MaxWorkers, m.pool.ErrorCount())))
+
+	// Part map
+	if len(m.parts) > 0 {
+		b.WriteString(m.partMap())
+		b.WriteString("\n\n")
+	}
+
+	// Workers
+	fmt.Fprintf(&b, "%s\n", tuiMutedStyle.Render(fmt.Sprintf("  %-7s %-40s %-6s %-20s %s", "WORKER", "PROXY", "PART", "PROGRESS", "SPEED")))
+	for _, worker := range m.workers {
+		line := fmt.Sprintf("  %-7d %-40s ", worker.Worker, truncate(worker.Proxy, 40))
+		if worker.Part < 0 {
+			line += tuiMutedStyle.Render("idle")
+		} else {
+			line += fmt.Sprintf("%-6d %-20s %.2f MB/s", worker.Part,
+				fmt.Sprintf("%.2f / %.2f MB", float64(worker.Downloaded)/(1024*1024), float64(max(worker.Size, 0))/(1024*1024)), worker.Speed/(1024*1024))
+		}
+		if worker.Worker == m.selected {
+			line = tuiSelectStyle.Render(">" + line[1:])
+		}
+		b.WriteString(line + "\n")
+	}
+	if len(m.workers) == 0 {
+		b.WriteString(tuiMutedStyle.Render("  no running workers") + "\n")
+	}
+
+	// Recent errors, the newest first
+	b.WriteString("\n" + tuiMutedStyle.Render("  RECENT ERRORS") + "\n")
+	if len(m.errors) == 0 {
+		b.WriteString(tuiMutedStyle.Render("  none") + "\n")
+	}
+	for i := len(m.errors) - 1; i >= max(len(m.errors)-5, 0); i-- {
+		downloadErr := m.errors[i]
+		fmt.Fprintf(&b, "  %s  worker %-3d part %-5d %-12s %s\n", downloadErr.Time.Format("15:04:05"), downloadErr.Worker, downloadErr.Part,
+			tuiErrorStyle.Render(downloadErr.Reason), truncate(downloadErr.Proxy, 40))
+	}
+
+	b.WriteString("\n")
+	if m.message != "" {
+		b.WriteString("  " + m.message + "\n")
+	}
+	b.WriteString(tuiMutedStyle.Render("  p pause/resume · s skip proxy of selected worker · +/- workers · ↑/↓ select · q quit") + "\n")
+	return b.String()
+}
+
+// partMap draws a cell for each part: downloaded, being downloaded or pending.
+// If there are too many parts, each cell covers several of them.
+func (m *tuiModel) partMap() string {
+	width := max(m.width-4, 10)
+	cells := min(len(m.parts), width*tuiMaxMapRows)
+	perCell := (len(m.parts) + cells - 1) / cells
+
+	active := make(map[int]bool, len(m.workers))
+	for _, worker := range m.workers {
+		if worker.Part >= 0 {
+			active[worker.Part] = true
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("  ")
+	for cell := 0; cell*perCell < len(m.parts); cell++ {
+		if cell > 0 && cell%width == 0 {
+			b.WriteString("\n  ")
+		}
+		done, downloading := true, false
+		for _, part := range m.parts[cell*perCell : min((cell+1)*perCell, len(m.parts))] {
+			done = done && part.Downloaded
+			downloading = downloading || active[part.Number]
+		}
+		switch {
+		case done:
+			b.WriteString(tuiDoneStyle.Render("█"))
+		case downloading:
+			b.WriteString(tuiActiveStyle.Render("▓"))
+		default:
+			b.WriteString(tuiPendingStyle.Render("░"))
+		}
+	}
+	return b.String()
+}
+
+// truncate shortens s to n characters.
+func truncate(s string, n int) string {
+	if len([]rune(s)) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// upstreamProxy is the proxy all outgoing connections are tunneled through, nil to connect directly.
+var upstreamProxy *url.URL
+
+// ParseUpstreamProxy parses the -upstream-proxy address. Only HTTP and HTTPS proxies
+// can be used, connections are tunneled through them with CONNECT.
+func ParseUpstreamProxy(address string) (*url.URL, error) {
+	normalized, err := NormalizeProxyAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	proxyURL, err := url.Parse(normalized)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, fmt.Errorf("upstream proxy must be an http or https proxy, got %q", proxyURL.Scheme)
+	}
+	return proxyURL, nil
+}
+
+// dialThroughUpstream returns a dial function that tunnels connections through
+// the upstream proxy, or the plain dialer if no upstream proxy is set.
+// Pool proxies of any scheme are then reached through the tunnel.
+func dialThroughUpstream(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if upstreamProxy == nil {
+		return dialer.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialUpstream(ctx, dialer, upstreamProxy, addr)
+	}
+}
+
+// dialUpstream opens a CONNECT tunnel to addr through the upstream proxy.
+func dialUpstream(ctx context.Context, dialer *net.Dialer, upstream *url.URL, addr string) (net.Conn, error) {
+	upstreamAddr := upstream.Host
+	if upstream.Port() == "" {
+		upstreamAddr = net.JoinHostPort(upstream.Hostname(), map[string]string{"http": "80", "https": "443"}[upstream.Scheme])
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", upstreamAddr)
+	if err != nil {
+		return nil, fmt.Errorf("upstream proxy: %w", err)
+	}
+
+	// The handshake with the upstream proxy is limited by the connect timeout
+	if dialer.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+
+	if upstream.Scheme == "https" {
+		config := &tls.Config{}
+		if proxyTLSConfig != nil {
+			config = proxyTLSConfig.Clone()
+		}
+		config.ServerName = upstream.Hostname()
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("upstream proxy: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if upstream.User != nil {
+		password, _ := upstream.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(upstream.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused tunnel to %s: %s", addr, resp.Status)
+	}
+	// The tunnel is not used by the client before CONNECT succeeds, so nothing else can be buffered
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy sent unexpected data after CONNECT to %s", addr)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
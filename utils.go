@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -13,6 +14,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/lipgloss"
@@ -20,11 +22,65 @@ import (
 	"github.com/schollz/progressbar/v3"
 )
 
+// ErrTooSlow is returned when a part download falls below the minimum throughput.
+var ErrTooSlow = errors.New("download too slow")
+
+// ErrInactive is returned when no data is received for the inactivity timeout.
+var ErrInactive = errors.New("inactivity timeout")
+
+// ErrSizeMismatch is returned when a downloaded part or file has an unexpected size.
+var ErrSizeMismatch = errors.New("incorrect size")
+
+// StatusError is returned when the server responds with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned unexpected status: %v", e.Status)
+}
+
+// FailureReason classifies a download error: dial, proxy, tls, timeout, too slow,
+// status <code>, size mismatch or other.
+func FailureReason(err error) string {
+	var statusErr *StatusError
+	var opErr *net.OpError
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrTooSlow):
+		return "too slow"
+	case errors.Is(err, ErrSkipped):
+		return "skipped"
+	case errors.Is(err, ErrSizeMismatch):
+		return "size mismatch"
+	case errors.As(err, &statusErr):
+		return "status " + strconv.Itoa(statusErr.StatusCode)
+	case errors.As(err, &certErr), errors.As(err, &alertErr), errors.As(err, &recordErr):
+		return "tls"
+	case errors.Is(err, ErrInactive), errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+		return "proxy"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "dial"
+	case strings.Contains(err.Error(), "tls: "):
+		return "tls"
+	}
+	return "other"
+}
+
 type FilePart struct {
-	Number     int
-	Start      int64
-	End        int64
-	Downloaded bool
+	Number     int   `json:"number"`
+	Start      int64 `json:"start"`
+	End        int64 `json:"end"`
+	Downloaded bool  `json:"downloaded"`
 }
 
 // PrepareOutputPath takes userPath (e.g., "file.mp4", "folder/file.mp4", or "/home/u/file.mp4")
@@ -47,42 +103,44 @@ func PrepareOutputPath(userPath string) (absPath string, workDir string, err err
 	return absPath, workDir, nil
 }
 
-func ReadLines(path string) ([]string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-	return lines, scanner.Err()
+// FileInfo describes the remote file as reported by the server.
+type FileInfo struct {
+	Name          string
+	ContentLength int64  // -1 if the server did not report the size
+	AcceptRanges  bool   // server answers range requests with 206 Partial Content
+	FinalURL      string // URL after following all redirects
+	ETag          string
 }
 
-func GetFileInfo(fileURL, proxyURL string) (int64, string, error) {
-	// Create a base transport with disabled certificate verification
+// probeProxy selects the proxy for file info requests made without a proxy URL.
+// It follows the environment proxy settings, or the PAC file if one is used.
+var probeProxy = http.ProxyFromEnvironment
+
+func GetFileInfo(fileURL, proxyURL string) (FileInfo, error) {
+	// Create a base transport with the configured certificate verification
 	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext:     dialThroughUpstream(&net.Dialer{Timeout: time.Duration(connectTimeout) * time.Second}),
+		TLSClientConfig: tlsConfig,
 	}
 
 	// If there is a proxy, set it in the transport
 	if proxyURL != "" {
 		proxy, err := url.Parse(proxyURL)
 		if err != nil {
-			return 0, "", err
+			return FileInfo{}, err
 		}
 		transport.Proxy = http.ProxyURL(proxy)
+	} else {
+		transport.Proxy = probeProxy
 	}
+	splitProxyTLS(transport)
 
 	client := &http.Client{
 		Transport: transport,
 	}
 
-	var contentLength int64
-	fileName := ""
+	info := FileInfo{ContentLength: -1, FinalURL: fileURL}
+	acceptRanges := ""
 
 	// Send HEAD request
 	resp, err := client.Head(fileURL)
@@ -90,8 +148,10 @@ func GetFileInfo(fileURL, proxyURL string) (int64, string, error) {
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			return 0, "", fmt.Errorf("server returned non-200 status: %v", resp.Status)
+			return FileInfo{}, fmt.Errorf("server returned non-200 status: %v", resp.Status)
 		}
+		info.FinalURL = resp.Request.URL.String()
+		info.ETag = resp.Header.Get("ETag")
 
 		// Get filename from Content-Disposition header
 		contentDisposition := resp.Header.Get("Content-Disposition")
@@ -101,7 +161,8 @@ func GetFileInfo(fileURL, proxyURL string) (int64, string, error) {
 			for part := range parts {
 				part = strings.TrimSpace(part)
 				if value, ok := strings.CutPrefix(part, "filename="); ok {
-					fileName = strings.Trim(value, `"`)
+					// Only the name is used, the server must not choose the directory
+					info.Name = baseFileName(strings.Trim(value, `"`))
 					break
 				}
 			}
@@ -110,31 +171,79 @@ func GetFileInfo(fileURL, proxyURL string) (int64, string, error) {
 		// Read content length
 		contentLengthStr := resp.Header.Get("Content-Length")
 		if contentLengthStr != "" {
-			contentLength, err = strconv.ParseInt(contentLengthStr, 10, 64)
+			contentLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
+			if err == nil && contentLength > 0 {
+				info.ContentLength = contentLength
+			}
 		}
+
+		acceptRanges = strings.ToLower(resp.Header.Get("Accept-Ranges"))
 	}
 
 	// If no filename was found in the header, use the last part of the URL
-	if fileName == "" {
+	if info.Name == "" {
 		log.Debug("Filename not found in Content-Disposition header, using filename from URL")
-		parsedURL, err := url.Parse(fileURL)
-		if err == nil {
-			fileName = filepath.Base(parsedURL.Path)
-		} else {
-			// Fallback if URL parsing fails
-			fileName = "downloaded_file"
+		if parsedURL, err := url.Parse(fileURL); err == nil {
+			info.Name = baseFileName(parsedURL.Path)
+		}
+		// Fallback if URL parsing fails or the path has no file name
+		if info.Name == "" {
+			info.Name = "downloaded_file"
 		}
 	}
 
-	if contentLength != 0 {
-		return contentLength, fileName, nil
+	if acceptRanges == "none" {
+		log.Warn("Server does not accept range requests.")
+		return info, nil
+	}
+
+	// Test if the server really answers range requests, headers are not always reliable
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to create range test request: %w", err)
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	testResp, err := client.Do(req)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("range test request failed: %w", err)
+	}
+	testResp.Body.Close()
+	info.FinalURL = testResp.Request.URL.String()
+	if info.ETag == "" {
+		info.ETag = testResp.Header.Get("ETag")
+	}
+
+	switch testResp.StatusCode {
+	case http.StatusPartialContent:
+		info.AcceptRanges = true
+		// The header should be in the format "bytes 0-0/12345"
+		if info.ContentLength < 0 {
+			if size, ok := parseContentRangeSize(testResp.Header.Get("Content-Range")); ok {
+				info.ContentLength = size
+			}
+		}
+	case http.StatusOK:
+		log.Warn("Server ignored the range request.")
+		if info.ContentLength < 0 && testResp.ContentLength > 0 {
+			info.ContentLength = testResp.ContentLength
+		}
+		return info, nil
+	default:
+		// Some servers reject range requests instead of ignoring them
+		log.Warn("Range test failed, the server is treated as not supporting range requests.", "status", testResp.Status)
+		return info, nil
+	}
+
+	if info.ContentLength > 0 {
+		return info, nil
 	}
 
 	// --- Fallback: Try to get size from a 416 Range Not Satisfiable response ---
 	log.Warn("Content-Length header not found. Probing for file size...")
-	req, err := http.NewRequest("GET", fileURL, nil)
+	req, err = http.NewRequest("GET", fileURL, nil)
 	if err != nil {
-		return 0, "", fmt.Errorf("failed to create probe request: %w", err)
+		return FileInfo{}, fmt.Errorf("failed to create probe request: %w", err)
 	}
 
 	// Request a byte range that is almost certainly out of bounds (1TB)
@@ -142,32 +251,56 @@ func GetFileInfo(fileURL, proxyURL string) (int64, string, error) {
 
 	probeResp, err := client.Do(req)
 	if err != nil {
-		return 0, "", fmt.Errorf("probe request failed: %w", err)
+		return FileInfo{}, fmt.Errorf("probe request failed: %w", err)
 	}
 	defer probeResp.Body.Close()
 
 	if probeResp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
-		return 0, "", fmt.Errorf("probe failed: server returned unexpected status %s instead of 416", probeResp.Status)
-	}
-
-	contentRange := probeResp.Header.Get("Content-Range")
-	if contentRange == "" {
-		return 0, "", fmt.Errorf("probe failed: server did not return a Content-Range header")
+		log.Warn("Could not determine file size.", "status", probeResp.Status)
+		return info, nil
 	}
 
 	// The header should be in the format "bytes */12345"
-	parts := strings.Split(contentRange, "/")
-	if len(parts) != 2 {
-		return 0, "", fmt.Errorf("probe failed: invalid Content-Range format: %s", contentRange)
+	contentLength, ok := parseContentRangeSize(probeResp.Header.Get("Content-Range"))
+	if !ok {
+		log.Warn("Could not determine file size.", "content range", probeResp.Header.Get("Content-Range"))
+		return info, nil
 	}
+	info.ContentLength = contentLength
 
-	contentLength, err = strconv.ParseInt(parts[1], 10, 64)
-	if err != nil {
-		return 0, "", fmt.Errorf("probe failed: could not parse file size from Content-Range: %s", contentRange)
+	log.Info("Successfully probed file size.", "size", contentLength)
+	return info, nil
+}
+
+// baseFileName returns the last element of path if it can be used as a file name
+// in the output directory, otherwise an empty string.
+func baseFileName(path string) string {
+	name := filepath.Base(path)
+	if name == "." || !filepath.IsLocal(name) {
+		return ""
 	}
+	return name
+}
 
-	log.Info("Successfully probed file size.", "size", contentLength)
-	return contentLength, fileName, nil
+// SameETag reports whether two ETags identify the same file. Unknown ETags always match
+// and the weak validator prefix is ignored, since CDNs often add or strip it.
+func SameETag(a, b string) bool {
+	a, b = strings.TrimPrefix(a, "W/"), strings.TrimPrefix(b, "W/")
+	return a == "" || b == "" || a == b
+}
+
+// parseContentRangeSize returns the complete length from a Content-Range header
+// like "bytes 0-0/12345" or "bytes */12345".
+func parseContentRangeSize(contentRange string) (int64, bool) {
+	_, sizeStr, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 10, 64)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+	return size, true
 }
 
 func DivideFileIntoParts(totalLength int64, partSizeBytes int64) []FilePart {
@@ -221,33 +354,20 @@ func (tr *trackReader) Read(p []byte) (n int, err error) {
 	return
 }
 
-func DownloadPartialFile(fileURL, proxyURL, outputPath string, startByte, endByte int64, bar *progressbar.ProgressBar, timeout time.Duration, onProgress func(int64)) (int64, error) {
-	// Transport with custom Dialer and disabled TLS verification
-	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   5 * time.Second, // TCP connection timeout
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		TLSHandshakeTimeout:   5 * time.Second,                       // timeout for TLS handshake
-		ResponseHeaderTimeout: 5 * time.Second,                       // timeout for the first headers
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true}, // ignore certificate
-	}
-
-	// Proxy parsing
-	if proxyURL != "" {
-		proxy, err := url.Parse(proxyURL)
-		if err != nil {
-			return 0, err
-		}
-		transport.Proxy = http.ProxyURL(proxy)
-	}
+func DownloadPartialFile(ctx context.Context, client *http.Client, fileURL, proxyURL, outputPath string, startByte, endByte int64, bar *progressbar.ProgressBar, timeout time.Duration, onProgress func(int64)) (int64, error) {
+	return downloadToFile(ctx, client, fileURL, proxyURL, outputPath, fmt.Sprintf("bytes=%d-%d", startByte, endByte), bar, timeout, onProgress)
+}
 
-	client := &http.Client{
-		Transport: transport,
-	}
+// DownloadFile downloads the whole file in a single stream, for servers without range support.
+func DownloadFile(ctx context.Context, client *http.Client, fileURL, proxyURL, outputPath string, bar *progressbar.ProgressBar, timeout time.Duration, onProgress func(int64)) (int64, error) {
+	return downloadToFile(ctx, client, fileURL, proxyURL, outputPath, "", bar, timeout, onProgress)
+}
 
+// downloadToFile writes the response body to outputPath. If byteRange is set,
+// the server must answer with 206 Partial Content, otherwise with 200 OK.
+func downloadToFile(ctx context.Context, client *http.Client, fileURL, proxyURL, outputPath, byteRange string, bar *progressbar.ProgressBar, timeout time.Duration, onProgress func(int64)) (int64, error) {
 	// Create a context that can be cancelled
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(withConnTrace(ctx))
 	defer cancel()
 
 	// Prepare the request with the Range header and context
@@ -255,7 +375,11 @@ func DownloadPartialFile(fileURL, proxyURL, outputPath string, startByte, endByt
 	if err != nil {
 		return 0, err
 	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", startByte, endByte))
+	expectedStatus := http.StatusOK
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+		expectedStatus = http.StatusPartialContent
+	}
 
 	// Execute the request
 	resp, err := client.Do(req)
@@ -264,8 +388,8 @@ func DownloadPartialFile(fileURL, proxyURL, outputPath string, startByte, endByt
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusPartialContent {
-		return 0, fmt.Errorf("server returned unexpected status: %v", resp.Status)
+	if resp.StatusCode != expectedStatus {
+		return 0, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
 	// Write to file
@@ -277,11 +401,13 @@ func DownloadPartialFile(fileURL, proxyURL, outputPath string, startByte, endByt
 
 	// Setup inactivity timer
 	var timer *time.Timer
+	var inactive atomic.Bool
 	if timeout > 0 {
 		timer = time.AfterFunc(timeout, func() {
 			if verbose {
 				log.Debug("Inactivity timeout reached, switching proxy...", "timeout", timeout, "proxy", proxyURL)
 			}
+			inactive.Store(true)
 			cancel()
 		})
 		defer timer.Stop()
@@ -298,10 +424,37 @@ func DownloadPartialFile(fileURL, proxyURL, outputPath string, startByte, endByt
 		}
 	}
 
+	// Abort if the throughput stays below the minimum speed for the whole window
+	var windowBytes atomic.Int64
+	var tooSlow atomic.Bool
+	if minSpeed > 0 && minSpeedTime > 0 {
+		window := time.Duration(minSpeedTime) * time.Second
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if windowBytes.Swap(0) < minSpeed*1024*int64(minSpeedTime) {
+						if verbose {
+							log.Debug("Download speed below minimum, switching proxy...", "min speed", fmt.Sprintf("%d KB/s", minSpeed), "proxy", proxyURL)
+						}
+						tooSlow.Store(true)
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+
 	// Track downloaded bytes
 	reader = &trackReader{
 		Reader: reader,
 		OnRead: func(n int) {
+			windowBytes.Add(int64(n))
 			if onProgress != nil {
 				onProgress(int64(n))
 			}
@@ -316,6 +469,13 @@ func DownloadPartialFile(fileURL, proxyURL, outputPath string, startByte, endByt
 		written, err = io.Copy(io.MultiWriter(file, bar), reader)
 	}
 
+	if err != nil && tooSlow.Load() {
+		err = fmt.Errorf("%w: less than %d KB/s for %ds", ErrTooSlow, minSpeed, minSpeedTime)
+	}
+	if err != nil && inactive.Load() {
+		err = fmt.Errorf("%w: no data for %s", ErrInactive, timeout)
+	}
+
 	return written, err
 }
 
@@ -422,7 +582,7 @@ func PrintDownloadStatus(parts []FilePart, partSize, contentLength int64, totalD
 
 func DetailsPrompt(parts []FilePart, proxyErrors int) string {
 	totalParts := len(parts)
-	downloadedParts := 1
+	downloadedParts := 0
 
 	for _, part := range parts {
 		if part.Downloaded {
@@ -438,10 +598,10 @@ func DetailsPrompt(parts []FilePart, proxyErrors int) string {
 }
 
 // [Google Gemini 2.0 Flash]
-// SaveContentLengthToFile saves the content length to a file in the work directory.
+// SaveContentLengthToFile saves the content length and ETag to a file in the work directory.
 // If the file exists, it reads the content length from the file and compares it to the current content length.
-// If the content lengths do not match, it returns an error.
-func SaveContentLengthToFile(workDir, outputFileName string, contentLength int64) (string, error) {
+// If the content lengths do not match, it returns an error. The same applies to the ETag if both are known.
+func SaveContentLengthToFile(workDir, outputFileName string, contentLength int64, etag string) (string, error) {
 	infoFilePath := filepath.Join(workDir, outputFileName+".info.txt")
 
 	// Check if the file exists
@@ -467,6 +627,13 @@ func SaveContentLengthToFile(workDir, outputFileName string, contentLength int64
 			return infoFilePath, fmt.Errorf("file size on server has changed. Link probably expired. Stored size: %d, current size: %d", storedContentLength, contentLength)
 		}
 
+		// The ETag is stored in the second line, info files of older versions don't have it
+		if scanner.Scan() {
+			if storedETag := scanner.Text(); !SameETag(storedETag, etag) {
+				return infoFilePath, fmt.Errorf("file on server has changed. Stored ETag: %s, current ETag: %s", storedETag, etag)
+			}
+		}
+
 		log.Info("Resuming previous download.")
 		return infoFilePath, nil
 	} else if !os.IsNotExist(err) {
@@ -481,7 +648,7 @@ func SaveContentLengthToFile(workDir, outputFileName string, contentLength int64
 	}
 	defer file.Close()
 
-	_, err = file.WriteString(strconv.FormatInt(contentLength, 10))
+	_, err = file.WriteString(strconv.FormatInt(contentLength, 10) + "\n" + etag)
 	if err != nil {
 		return infoFilePath, fmt.Errorf("failed to write content length to info file: %w", err)
 	}